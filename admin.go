@@ -0,0 +1,221 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	selectorNameRE  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	selectorLabelRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+)
+
+// labelMatcher matches the value of a label, like a Prometheus label matcher.
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	default:
+		panic(fmt.Sprintf("unknown label matcher operator '%s'", m.op))
+	}
+}
+
+// seriesSelector selects series like a Prometheus series selector, e.g.
+// foo{job="x",instance=~"web-.*"}.
+type seriesSelector []*labelMatcher
+
+func (s seriesSelector) matches(name string, labels prometheus.Labels) bool {
+	for _, m := range s {
+		value := labels[m.name]
+		if m.name == "__name__" {
+			value = name
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSeriesSelector parses a series selector. As in Prometheus, at least one
+// matcher must not match the empty string, so that a selector can't select
+// all series by accident.
+func parseSeriesSelector(input string) (seriesSelector, error) {
+	var selector seriesSelector
+	s := strings.TrimSpace(input)
+	if name := selectorNameRE.FindString(s); name != "" {
+		selector = append(selector, &labelMatcher{name: "__name__", op: "=", value: name})
+		s = strings.TrimSpace(s[len(name):])
+	}
+
+	if s != "" {
+		if s[0] != '{' || s[len(s)-1] != '}' {
+			return nil, fmt.Errorf("invalid series selector %q", input)
+		}
+		s = strings.TrimSpace(s[1 : len(s)-1])
+		for s != "" {
+			m, rest, err := parseLabelMatcher(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid series selector %q: %v", input, err)
+			}
+			selector = append(selector, m)
+			s = strings.TrimSpace(rest)
+			if s == "" {
+				break
+			}
+			if s[0] != ',' {
+				return nil, fmt.Errorf("invalid series selector %q: expected ',' before %q", input, s)
+			}
+			s = strings.TrimSpace(s[1:])
+		}
+	}
+
+	for _, m := range selector {
+		if !m.matches("") {
+			return selector, nil
+		}
+	}
+	return nil, fmt.Errorf("series selector %q must contain at least one matcher that doesn't match the empty string", input)
+}
+
+// parseLabelMatcher parses a label matcher at the start of s and returns the
+// rest of s.
+func parseLabelMatcher(s string) (*labelMatcher, string, error) {
+	m := &labelMatcher{name: selectorLabelRE.FindString(s)}
+	if m.name == "" {
+		return nil, "", fmt.Errorf("expected a label name at %q", s)
+	}
+	s = strings.TrimSpace(s[len(m.name):])
+
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(s, op) {
+			m.op = op
+			break
+		}
+	}
+	if m.op == "" {
+		return nil, "", fmt.Errorf("expected a matcher operator at %q", s)
+	}
+	s = strings.TrimSpace(s[len(m.op):])
+
+	if s == "" || s[0] != '"' {
+		return nil, "", fmt.Errorf("expected a quoted label value at %q", s)
+	}
+	end := 1
+	for ; end < len(s) && s[end] != '"'; end++ {
+		if s[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(s) {
+		return nil, "", fmt.Errorf("unterminated label value at %q", s)
+	}
+	value, err := strconv.Unquote(s[:end+1])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid label value %s: %v", s[:end+1], err)
+	}
+	m.value = value
+
+	if m.op == "=~" || m.op == "!~" {
+		// Label matchers are fully anchored, as in Prometheus.
+		if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, "", fmt.Errorf("invalid regex %q: %v", value, err)
+		}
+	}
+	return m, s[end+1:], nil
+}
+
+// readAdminToken reads the token that authenticates requests to the admin API
+// from a file. Surrounding whitespace is ignored.
+func readAdminToken(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// authenticated wraps an admin API handler, requiring requests to carry the
+// token as a bearer token.
+func authenticated(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// deleteSeriesHandler deletes the series selected by the match[] parameters,
+// e.g. DELETE /api/v1/series?match[]=foo{job="x"}.
+func deleteSeriesHandler(exporter *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "DELETE, POST")
+			respondError(w, http.StatusMethodNotAllowed, fmt.Errorf("only DELETE and POST requests allowed"))
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(r.Form["match[]"]) == 0 {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("no match[] parameter provided"))
+			return
+		}
+
+		var selectors []seriesSelector
+		for _, s := range r.Form["match[]"] {
+			selector, err := parseSeriesSelector(s)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			selectors = append(selectors, selector)
+		}
+
+		respond(w, struct {
+			Deleted int `json:"deleted"`
+		}{exporter.deleteSeries(selectors)})
+	})
+}
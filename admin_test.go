@@ -0,0 +1,174 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseSeriesSelector(t *testing.T) {
+	scenarios := []struct {
+		selector string
+		matches  map[string]prometheus.Labels
+		rejects  map[string]prometheus.Labels
+		err      string
+	}{
+		{
+			selector: `foo`,
+			matches:  map[string]prometheus.Labels{"foo": {"job": "x"}},
+			rejects:  map[string]prometheus.Labels{"bar": {"job": "x"}},
+		},
+		{
+			selector: `foo{job="x"}`,
+			matches:  map[string]prometheus.Labels{"foo": {"job": "x", "env": "prod"}},
+			rejects:  map[string]prometheus.Labels{"foo": {"job": "y"}},
+		},
+		{
+			selector: ` { __name__ =~ "fo+" , job != "y", env!~"dev|test", quoted="a\"b,}" } `,
+			matches:  map[string]prometheus.Labels{"foooo": {"job": "x", "quoted": `a"b,}`}},
+			rejects:  map[string]prometheus.Labels{"foo": {"job": "x", "env": "dev", "quoted": `a"b,}`}},
+		},
+		{
+			selector: `{job=~".*"}`,
+			err:      "must contain at least one matcher that doesn't match the empty string",
+		},
+		{
+			selector: `foo{job="x"`,
+			err:      `invalid series selector "foo{job=\"x\""`,
+		},
+		{
+			selector: `foo{job="x" env="y"}`,
+			err:      "expected ',' before",
+		},
+		{
+			selector: `foo{job=x}`,
+			err:      "expected a quoted label value",
+		},
+		{
+			selector: `foo{job=~"("}`,
+			err:      "invalid regex",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		selector, err := parseSeriesSelector(scenario.selector)
+		if scenario.err != "" {
+			if err == nil || !strings.Contains(err.Error(), scenario.err) {
+				t.Fatalf("%d. Expected error %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. Unexpected error: %s", i, err)
+		}
+		for name, labels := range scenario.matches {
+			if !selector.matches(name, labels) {
+				t.Fatalf("%d. Expected %s%v to match", i, name, labels)
+			}
+		}
+		for name, labels := range scenario.rejects {
+			if selector.matches(name, labels) {
+				t.Fatalf("%d. Expected %s%v not to match", i, name, labels)
+			}
+		}
+	}
+}
+
+func TestDeleteSeriesHandler(t *testing.T) {
+	ex := NewExporter(&metricMapper{})
+	events := make(chan Events, 1)
+	events <- Events{
+		&GaugeEvent{metricName: "deleted.gauge", value: 1, labels: map[string]string{"job": "x"}},
+		&GaugeEvent{metricName: "deleted.gauge", value: 1, labels: map[string]string{"job": "y"}},
+		&CounterEvent{metricName: "kept.counter", value: 1, labels: map[string]string{"job": "x"}},
+	}
+	close(events)
+	ex.Listen(events)
+
+	handler := authenticated("secret", deleteSeriesHandler(ex))
+	request := func(method, token string, selectors ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/series?"+url.Values{"match[]": selectors}.Encode(), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	scenarios := []struct {
+		method    string
+		token     string
+		selectors []string
+		code      int
+		body      string
+	}{
+		{method: "DELETE", token: "", selectors: []string{"deleted_gauge"}, code: http.StatusUnauthorized},
+		{method: "DELETE", token: "wrong", selectors: []string{"deleted_gauge"}, code: http.StatusUnauthorized},
+		{method: "GET", token: "secret", selectors: []string{"deleted_gauge"}, code: http.StatusMethodNotAllowed},
+		{method: "DELETE", token: "secret", code: http.StatusBadRequest, body: "no match[] parameter provided"},
+		{method: "DELETE", token: "secret", selectors: []string{`{job=""}`}, code: http.StatusBadRequest, body: "at least one matcher"},
+		{method: "DELETE", token: "secret", selectors: []string{`deleted_gauge{job="x"}`, `missing`}, code: http.StatusOK, body: `"deleted":1`},
+	}
+	for i, scenario := range scenarios {
+		rec := request(scenario.method, scenario.token, scenario.selectors...)
+		if rec.Code != scenario.code {
+			t.Fatalf("%d. Expected status %d, got %d: %s", i, scenario.code, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), scenario.body) {
+			t.Fatalf("%d. Expected body to contain %q, got %q", i, scenario.body, rec.Body.String())
+		}
+	}
+
+	expected := []string{`deleted_gauge{job="y"}`, `kept_counter{job="x"}`}
+	if got := gatherSeries(t, ex.gatherer(false)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v, got %v", expected, got)
+	}
+	if len(ex.Gauges.Elements) != 1 {
+		t.Fatalf("Expected the deleted gauge to be removed from its container")
+	}
+}
+
+func TestDeleteLines(t *testing.T) {
+	ex := NewExporter(&metricMapper{})
+	listen := func(lines ...string) {
+		events := make(chan Events, len(lines))
+		for _, line := range lines {
+			events <- lineToEvents(line)
+		}
+		close(events)
+		ex.Listen(events)
+	}
+	listen("deleted.gauge:1|g|#job:x", "deleted.gauge:1|g|#job:y")
+
+	// Deletion lines are ignored unless enabled.
+	listen("deleted.gauge:delete|g|#job:x")
+	if len(ex.Gauges.Elements) != 2 {
+		t.Fatalf("Expected deletion lines to be ignored")
+	}
+
+	ex.deleteLines = true
+	listen("deleted.gauge:delete|g|#job:x", "deleted.gauge:delete|g|#job:z")
+	expected := []string{`deleted_gauge{job="y"}`}
+	if got := gatherSeries(t, ex.gatherer(false)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v, got %v", expected, got)
+	}
+}
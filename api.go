@@ -0,0 +1,192 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// apiResponse is the envelope of all API responses, following the Prometheus
+// HTTP API.
+type apiResponse struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	respondJSON(w, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+func respondError(w http.ResponseWriter, code int, err error) {
+	respondJSON(w, code, apiResponse{Status: "error", Error: err.Error()})
+}
+
+func respondJSON(w http.ResponseWriter, code int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorln("Error writing API response:", err)
+	}
+}
+
+// mappingInfo describes a loaded mapping, with the defaults applied.
+type mappingInfo struct {
+	Index           int               `json:"index"`
+	ID              string            `json:"id,omitempty"`
+	Match           stringList        `json:"match"`
+	MatchType       matchType         `json:"match_type"`
+	Regex           stringList        `json:"regex"`
+	MatchMetricType metricTypeList    `json:"match_metric_type,omitempty"`
+	MatchLabels     map[string]string `json:"match_labels,omitempty"`
+	Name            string            `json:"name"`
+	Labels          prometheus.Labels `json:"labels,omitempty"`
+	Help            string            `json:"help,omitempty"`
+	Action          actionType        `json:"action"`
+	OutputType      outputType        `json:"output_type,omitempty"`
+	TimerType       timerType         `json:"timer_type,omitempty"`
+	TimerUnit       timerUnit         `json:"timer_unit"`
+	Buckets         []float64         `json:"buckets"`
+	Quantiles       []metricObjective `json:"quantiles"`
+	LabelPrecedence labelPrecedence   `json:"label_precedence"`
+	Hits            uint64            `json:"hits"`
+}
+
+func newMappingInfo(m *metricMapping) mappingInfo {
+	regexes := make(stringList, 0, len(m.regexes))
+	for _, regex := range m.regexes {
+		regexes = append(regexes, regex.String())
+	}
+	return mappingInfo{
+		Index:           m.index,
+		ID:              m.ID,
+		Match:           m.Match,
+		MatchType:       m.MatchType,
+		Regex:           regexes,
+		MatchMetricType: m.MatchMetricType,
+		MatchLabels:     m.MatchLabels,
+		Name:            m.Name,
+		Labels:          m.Labels,
+		Help:            m.HelpText,
+		Action:          m.Action,
+		OutputType:      m.OutputType,
+		TimerType:       m.TimerType,
+		TimerUnit:       m.TimerUnit,
+		Buckets:         m.Buckets,
+		Quantiles:       m.Quantiles,
+		LabelPrecedence: m.LabelPrecedence,
+		Hits:            m.hitCount(),
+	}
+}
+
+// mappingsHandler lists the loaded mappings along with the number of events
+// they matched.
+func mappingsHandler(mapper *metricMapper) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mappings := mapper.currentMappings()
+		infos := make([]mappingInfo, 0, len(mappings))
+		for i := range mappings {
+			infos = append(infos, newMappingInfo(&mappings[i]))
+		}
+		respond(w, infos)
+	})
+}
+
+// matchResult describes how a metric is mapped.
+type matchResult struct {
+	// Mapping is the mapping matching the metric, if any.
+	Mapping    *mappingInfo      `json:"mapping"`
+	Dropped    bool              `json:"dropped"`
+	Name       string            `json:"name,omitempty"`
+	Labels     prometheus.Labels `json:"labels,omitempty"`
+	OutputType outputType        `json:"output_type,omitempty"`
+}
+
+var apiStatTypes = map[metricType]string{
+	metricTypeCounter: "c",
+	metricTypeGauge:   "g",
+	metricTypeTimer:   "ms",
+}
+
+// matchHandler reports how the metric given by the metric, type and tags
+// parameters is mapped, without recording anything.
+func matchHandler(exporter *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metric := r.FormValue("metric")
+		if metric == "" {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("missing metric parameter"))
+			return
+		}
+		t := metricType(r.FormValue("type"))
+		if t == "" {
+			t = metricTypeCounter
+		}
+		statType, ok := apiStatTypes[t]
+		if !ok {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("invalid type %q, must be one of counter, gauge or timer", t))
+			return
+		}
+		tags, err := parseAPITags(r.FormValue("tags"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		event, err := buildEvent(statType, metric, 0, false, tags)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var res matchResult
+		m, ok := exporter.mapEvent(event)
+		// The mapping handed out by mapEvent carries the expanded name, so
+		// describe the configured one.
+		if mappings := exporter.mapper.currentMappings(); m.present && m.mapping.index < len(mappings) {
+			info := newMappingInfo(&mappings[m.mapping.index])
+			res.Mapping = &info
+		}
+		if !ok {
+			res.Dropped = true
+		} else {
+			res.Name = m.name
+			res.Labels = m.labels
+			res.OutputType = m.outputType
+		}
+		respond(w, res)
+	})
+}
+
+// parseAPITags parses tags given as comma-separated key:value pairs, like
+// DogStatsD tags.
+func parseAPITags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	if s == "" {
+		return tags, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimPrefix(t, "#"), ":", 2)
+		if len(kv) < 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %q, must be key:value", t)
+		}
+		tags[escapeMetricName(kv[0])] = kv[1]
+	}
+	return tags, nil
+}
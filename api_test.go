@@ -0,0 +1,172 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const apiTestConfig = `---
+defaults:
+  timer_type: histogram
+mappings:
+- match: test.*.timer
+  name: "test_${1}_timer_seconds"
+  labels:
+    job: "$1"
+- match: test.dropped
+  name: "dropped"
+  action: drop
+`
+
+func TestMappingsHandler(t *testing.T) {
+	mapper := &metricMapper{}
+	if err := mapper.initFromYAMLString(apiTestConfig); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+	events := make(chan Events, 1)
+	events <- Events{
+		&TimerEvent{metricName: "test.web.timer", value: 1},
+		&TimerEvent{metricName: "test.api.timer", value: 1},
+		&CounterEvent{metricName: "test.dropped", value: 1},
+		&CounterEvent{metricName: "test.unmapped", value: 1},
+	}
+	close(events)
+	ex.Listen(events)
+
+	rec := httptest.NewRecorder()
+	mappingsHandler(mapper).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/mappings", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Status string
+		Data   []mappingInfo
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || len(resp.Data) != 2 {
+		t.Fatalf("Unexpected response: %s", rec.Body.String())
+	}
+
+	m := resp.Data[0]
+	if m.Index != 0 || m.Regex.String() != `^test\.([^.]*)\.timer$` || m.TimerType != timerTypeHistogram || len(m.Buckets) != len(prometheus.DefBuckets) || m.Hits != 2 {
+		t.Fatalf("Unexpected mapping 0: %+v", m)
+	}
+	m = resp.Data[1]
+	if m.Index != 1 || m.Action != actionTypeDrop || m.Hits != 1 {
+		t.Fatalf("Unexpected mapping 1: %+v", m)
+	}
+}
+
+func TestMatchHandler(t *testing.T) {
+	mapper := &metricMapper{}
+	if err := mapper.initFromYAMLString(apiTestConfig); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	handler := matchHandler(NewExporter(mapper))
+
+	scenarios := []struct {
+		query   string
+		code    int
+		mapping int
+		result  matchResult
+	}{
+		{
+			query:   "metric=test.web.timer&type=timer&tags=env:prod",
+			code:    http.StatusOK,
+			mapping: 0,
+			result: matchResult{
+				Name:       "test_web_timer_seconds",
+				Labels:     prometheus.Labels{"job": "web", "env": "prod"},
+				OutputType: outputTypeHistogram,
+			},
+		},
+		{
+			query:   "metric=test.dropped",
+			code:    http.StatusOK,
+			mapping: 1,
+			result:  matchResult{Dropped: true},
+		},
+		{
+			query:   "metric=test.unmapped&type=gauge",
+			code:    http.StatusOK,
+			mapping: -1,
+			result: matchResult{
+				Name:       "test_unmapped",
+				Labels:     prometheus.Labels{},
+				OutputType: outputTypeGauge,
+			},
+		},
+		{
+			query: "type=counter",
+			code:  http.StatusBadRequest,
+		},
+		{
+			query: "metric=test.web.timer&type=set",
+			code:  http.StatusBadRequest,
+		},
+		{
+			query: "metric=test.web.timer&tags=env",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/match?"+scenario.query, nil))
+		if rec.Code != scenario.code {
+			t.Fatalf("%d. Expected status %d, got %d: %s", i, scenario.code, rec.Code, rec.Body.String())
+		}
+		if scenario.code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Data matchResult
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Data
+		switch {
+		case scenario.mapping < 0 && res.Mapping != nil:
+			t.Fatalf("%d. Expected no mapping, got %+v", i, res.Mapping)
+		case scenario.mapping >= 0 && (res.Mapping == nil || res.Mapping.Index != scenario.mapping):
+			t.Fatalf("%d. Expected mapping %d, got %+v", i, scenario.mapping, res.Mapping)
+		case scenario.mapping >= 0 && res.Mapping.Name != mapper.Mappings[scenario.mapping].Name:
+			// The mapping is described as configured, not as applied.
+			t.Fatalf("%d. Expected mapping name %q, got %q", i, mapper.Mappings[scenario.mapping].Name, res.Mapping.Name)
+		}
+		res.Mapping = nil
+		if res.Labels == nil {
+			res.Labels = prometheus.Labels{}
+		}
+		if scenario.result.Labels == nil {
+			scenario.result.Labels = prometheus.Labels{}
+		}
+		if !reflect.DeepEqual(res, scenario.result) {
+			t.Fatalf("%d. Expected %+v, got %+v", i, scenario.result, res)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	defaultCardinalityWindow      = 10 * time.Minute
+	defaultCardinalityHashBuckets = 16
+)
+
+type cardinalityAction string
+
+const (
+	cardinalityActionStrip   cardinalityAction = "strip"
+	cardinalityActionHash    cardinalityAction = "hash"
+	cardinalityActionDefault cardinalityAction = ""
+)
+
+func (a *cardinalityAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch cardinalityAction(v) {
+	case cardinalityActionStrip, cardinalityActionDefault:
+		*a = cardinalityActionStrip
+	case cardinalityActionHash:
+		*a = cardinalityActionHash
+	default:
+		return fmt.Errorf("invalid label cardinality action %q", v)
+	}
+	return nil
+}
+
+// labelCardinality configures the detection of labels that take too many
+// distinct values.
+type labelCardinality struct {
+	// MaxValues is the number of distinct values a label may take per metric
+	// name within a window. 0 disables the detection.
+	MaxValues   int               `yaml:"max_values"`
+	Window      time.Duration     `yaml:"window"`
+	Action      cardinalityAction `yaml:"action"`
+	HashBuckets int               `yaml:"hash_buckets"`
+}
+
+// init validates the configuration and fills in the defaults.
+func (c *labelCardinality) init() error {
+	if c.MaxValues < 0 {
+		return fmt.Errorf("max_values must not be negative")
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	if c.HashBuckets < 0 {
+		return fmt.Errorf("hash_buckets must not be negative")
+	}
+	if c.Window == 0 {
+		c.Window = defaultCardinalityWindow
+	}
+	if c.Action == cardinalityActionDefault {
+		c.Action = cardinalityActionStrip
+	}
+	if c.HashBuckets == 0 {
+		c.HashBuckets = defaultCardinalityHashBuckets
+	}
+	return nil
+}
+
+// cardinalityTracker counts the distinct values of each label per metric name
+// within a window, and remembers the labels that exceeded the limit. Those
+// stay neutralised until the exporter is restarted.
+type cardinalityTracker struct {
+	windowStart time.Time
+	// values holds the distinct values by metric name and label name.
+	values      map[string]map[string]map[string]struct{}
+	neutralised map[string]map[string]bool
+	now         func() time.Time
+}
+
+func newCardinalityTracker() *cardinalityTracker {
+	return &cardinalityTracker{
+		values:      map[string]map[string]map[string]struct{}{},
+		neutralised: map[string]map[string]bool{},
+		now:         time.Now,
+	}
+}
+
+// observe records the label values of an event, and neutralises the labels
+// that exceed the limit.
+func (t *cardinalityTracker) observe(c labelCardinality, name string, labels prometheus.Labels) {
+	now := t.now()
+	if now.Sub(t.windowStart) >= c.Window {
+		t.values = map[string]map[string]map[string]struct{}{}
+		t.windowStart = now
+	}
+
+	for label, value := range labels {
+		if t.neutralised[name][label] {
+			continue
+		}
+		byLabel, ok := t.values[name]
+		if !ok {
+			byLabel = map[string]map[string]struct{}{}
+			t.values[name] = byLabel
+		}
+		values, ok := byLabel[label]
+		if !ok {
+			values = map[string]struct{}{}
+			byLabel[label] = values
+		}
+		values[value] = struct{}{}
+		if len(values) <= c.MaxValues {
+			continue
+		}
+
+		delete(byLabel, label)
+		if t.neutralised[name] == nil {
+			t.neutralised[name] = map[string]bool{}
+		}
+		t.neutralised[name][label] = true
+		log.Warnf("Label %q of metric %q took more than %d distinct values within %s, applying action %q to it for new series", label, name, c.MaxValues, c.Window, c.Action)
+		labelsNeutralised.WithLabelValues(name, label, string(c.Action)).Set(float64(now.UnixNano()) / 1e9)
+	}
+}
+
+// apply returns the labels with the values of neutralised labels stripped or
+// replaced by a hash bucket, and whether any label was changed.
+func (t *cardinalityTracker) apply(c labelCardinality, name string, labels prometheus.Labels) (prometheus.Labels, bool) {
+	neutralised := t.neutralised[name]
+	if len(neutralised) == 0 {
+		return labels, false
+	}
+
+	result := make(prometheus.Labels, len(labels))
+	changed := false
+	for label, value := range labels {
+		if neutralised[label] {
+			value = c.neutralise(value)
+			changed = true
+		}
+		result[label] = value
+	}
+	return result, changed
+}
+
+// neutralise returns the value that replaces the value of a neutralised label.
+// Stripped labels keep their name with an empty value, which Prometheus treats
+// like a missing label, as all series of a metric must have the same label
+// names.
+func (c labelCardinality) neutralise(value string) string {
+	if c.Action != cardinalityActionHash {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("bucket_%d", h.Sum32()%uint32(c.HashBuckets))
+}
+
+// neutraliseLabels tracks the label cardinality of a mapped event and, if it
+// creates a new series, neutralises its high-cardinality labels.
+func (b *Exporter) neutraliseLabels(m *mappedEvent) {
+	c := b.mapper.labelCardinality()
+	if c.MaxValues == 0 {
+		return
+	}
+
+	b.cardinality.observe(c, m.name, m.labels)
+	if _, ok := b.series[hashNameAndLabels(m.name, m.labels)]; ok {
+		return
+	}
+	if labels, changed := b.cardinality.apply(c, m.name, m.labels); changed {
+		m.labels = labels
+		m.neutralised = true
+	}
+}
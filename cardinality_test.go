@@ -0,0 +1,120 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestLabelCardinality(t *testing.T) {
+	request := func(id string) Event {
+		return &CounterEvent{metricName: "cardinality.alpha", value: 1, labels: map[string]string{"request": id, "env": "prod"}}
+	}
+
+	scenarios := []struct {
+		config string
+		// events are sent in batches, with the window passing in between.
+		events   []Events
+		expected []string
+		err      string
+	}{
+		{
+			config: "",
+			events: []Events{{request("1"), request("2"), request("3")}},
+			expected: []string{
+				`cardinality_alpha{env="prod",request="1"}`,
+				`cardinality_alpha{env="prod",request="2"}`,
+				`cardinality_alpha{env="prod",request="3"}`,
+			},
+		},
+		{
+			// Existing series are still recorded after the label is stripped.
+			config: "label_cardinality:\n  max_values: 2\n",
+			events: []Events{{request("1"), request("2"), request("3"), request("4"), request("1")}},
+			expected: []string{
+				`cardinality_alpha{env="prod",request=""}`,
+				`cardinality_alpha{env="prod",request="1"}`,
+				`cardinality_alpha{env="prod",request="2"}`,
+			},
+		},
+		{
+			config: "label_cardinality:\n  max_values: 2\n",
+			events: []Events{{request("1"), request("2")}, {request("3"), request("4")}},
+			expected: []string{
+				`cardinality_alpha{env="prod",request="1"}`,
+				`cardinality_alpha{env="prod",request="2"}`,
+				`cardinality_alpha{env="prod",request="3"}`,
+				`cardinality_alpha{env="prod",request="4"}`,
+			},
+		},
+		{
+			config: "label_cardinality:\n  max_values: 1\n  action: hash\n  hash_buckets: 1\n",
+			events: []Events{{request("1"), request("2"), request("3")}},
+			expected: []string{
+				`cardinality_alpha{env="prod",request="1"}`,
+				`cardinality_alpha{env="prod",request="bucket_0"}`,
+			},
+		},
+		{
+			config: "label_cardinality:\n  action: truncate\n",
+			err:    `invalid label cardinality action "truncate"`,
+		},
+		{
+			config: "label_cardinality:\n  max_values: -1\n",
+			err:    "label_cardinality: max_values must not be negative",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mapper := &metricMapper{}
+		err := mapper.initFromYAMLString(scenario.config)
+		if scenario.err != "" {
+			if err == nil || !strings.Contains(err.Error(), scenario.err) {
+				t.Fatalf("%d. Expected error %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. Config load error: %s", i, err)
+		}
+
+		ex := NewExporter(mapper)
+		now := time.Unix(1500000000, 0)
+		ex.cardinality.now = func() time.Time { return now }
+		for _, events := range scenario.events {
+			c := make(chan Events, 1)
+			c <- events
+			close(c)
+			ex.Listen(c)
+			now = now.Add(mapper.LabelCardinality.Window)
+		}
+
+		if got := gatherSeries(t, ex.gatherer(false)); !reflect.DeepEqual(got, scenario.expected) {
+			t.Fatalf("%d. Expected series %v, got %v", i, scenario.expected, got)
+		}
+	}
+
+	m := &dto.Metric{}
+	if err := labelsNeutralised.WithLabelValues("cardinality_alpha", "request", "strip").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.GetGauge().GetValue() == 0 {
+		t.Fatalf("Neutralisation of the request label was not recorded")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// checkConfig validates the mapping configuration at path and writes all
+// problems found to out. If lines is not nil, the StatsD lines read from it
+// are mapped with the configuration and the resulting series are written to
+// out as well.
+func checkConfig(path string, lines io.Reader, out io.Writer) error {
+	mapper := &metricMapper{}
+	if err := mapper.initFromFile(path); err != nil {
+		errs, ok := err.(configErrors)
+		if !ok {
+			errs = configErrors{err}
+		}
+		for _, err := range errs {
+			fmt.Fprintln(out, "Error:", err)
+		}
+		return err
+	}
+	fmt.Fprintf(out, "Mapping config is valid: %d mappings\n", len(mapper.Mappings))
+	if lines == nil {
+		return nil
+	}
+
+	exporter := NewExporter(mapper)
+	scanner := bufio.NewScanner(lines)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fmt.Fprintln(out, line)
+		events := lineToEvents(line)
+		if len(events) == 0 {
+			fmt.Fprintln(out, "  invalid line")
+			continue
+		}
+		for _, event := range events {
+			fmt.Fprintln(out, " ", describeEvent(exporter, event))
+		}
+	}
+	return scanner.Err()
+}
+
+// describeEvent returns the series an event is recorded in, along with its
+// type and buckets or quantiles.
+func describeEvent(exporter *Exporter, event Event) string {
+	m, ok := exporter.mapEvent(event)
+	if !ok {
+		return "dropped"
+	}
+
+	labels := make(model.LabelSet, len(m.labels))
+	for k, v := range m.labels {
+		labels[model.LabelName(k)] = model.LabelValue(v)
+	}
+	desc := fmt.Sprintf("%s%s %s", m.name, labels, m.outputType)
+	switch m.outputType {
+	case outputTypeHistogram:
+		desc += fmt.Sprintf(" buckets=%v", exporter.Histograms.buckets(m.mapping))
+	case outputTypeSummary:
+		quantiles := []float64{}
+		for _, q := range exporter.Summaries.quantiles(m.mapping) {
+			quantiles = append(quantiles, q.Quantile)
+		}
+		desc += fmt.Sprintf(" quantiles=%v", quantiles)
+	}
+	if !m.present {
+		desc += " (unmapped)"
+	}
+	return desc
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	scenarios := []struct {
+		config string
+		lines  string
+		valid  bool
+		output []string
+	}{
+		{
+			// All errors are reported, not only the first one.
+			config: `---
+mappings:
+- match: test.*
+  name: "0foo"
+- match: test.*.bar
+- match: test.*.baz
+  name: "baz"
+`,
+			output: []string{
+				"Error: ",
+				"mapping 0 (test.*): metric name '0foo'",
+				"mapping 1 (test.*.bar): metric mapping didn't set a metric name",
+			},
+		},
+		{
+			// Invalid options don't hide the problems of other mappings.
+			config: `---
+mappings:
+- match: test.*.timer
+  name: "timer"
+  timer_type: bogus
+- match: test.*.counter
+  name: "counter"
+  match_metric_type: bogus
+- match: test.*.gauge
+  name: "0gauge"
+`,
+			output: []string{
+				"mapping 0: invalid timer type 'bogus'",
+				"mapping 1: invalid metric type 'bogus'",
+				"mapping 2 (test.*.gauge): metric name '0gauge'",
+			},
+		},
+		{
+			config: `---
+mappings:
+- match: test.*.timer
+  timer_type: histogram
+  buckets: [ 0.1, 1 ]
+  name: "test_timer_seconds"
+  labels:
+    job: "$1"
+- match: test.*.summary
+  name: "test_summary_seconds"
+- match: test.dropped
+  name: "dropped"
+  action: drop
+`,
+			lines: `test.web.timer:5|ms
+test.web.summary:5|ms
+test.dropped:1|c
+test.unmapped:1|c|#env:prod
+garbage
+`,
+			valid: true,
+			output: []string{
+				"Mapping config is valid: 3 mappings",
+				"test.web.timer:5|ms\n  test_timer_seconds{job=\"web\"} histogram buckets=[0.1 1]\n",
+				"test.web.summary:5|ms\n  test_summary_seconds{} summary quantiles=[0.5 0.9 0.99]\n",
+				"test.dropped:1|c\n  dropped\n",
+				"test.unmapped:1|c|#env:prod\n  test_unmapped{env=\"prod\"} counter (unmapped)\n",
+				"garbage\n  invalid line\n",
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		f, err := ioutil.TempFile("", "statsd_exporter_check")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(scenario.config)
+		f.Close()
+
+		var out bytes.Buffer
+		err = checkConfig(f.Name(), strings.NewReader(scenario.lines), &out)
+		if scenario.valid && err != nil {
+			t.Fatalf("%d. Unexpected error: %s", i, err)
+		}
+		if !scenario.valid && err == nil {
+			t.Fatalf("%d. Expected error, got none", i)
+		}
+		for _, o := range scenario.output {
+			if !strings.Contains(out.String(), o) {
+				t.Fatalf("%d. Expected output to contain %q, got %q", i, o, out.String())
+			}
+		}
+	}
+}
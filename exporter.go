@@ -16,6 +16,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"fmt"
 	"hash/fnv"
@@ -24,6 +25,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -62,12 +65,14 @@ func hashNameAndLabels(name string, labels prometheus.Labels) uint64 {
 }
 
 type CounterContainer struct {
-	Elements map[uint64]prometheus.Counter
+	Elements   map[uint64]prometheus.Counter
+	registerer prometheus.Registerer
 }
 
-func NewCounterContainer() *CounterContainer {
+func NewCounterContainer(registerer prometheus.Registerer) *CounterContainer {
 	return &CounterContainer{
-		Elements: make(map[uint64]prometheus.Counter),
+		Elements:   make(map[uint64]prometheus.Counter),
+		registerer: registerer,
 	}
 }
 
@@ -80,7 +85,7 @@ func (c *CounterContainer) Get(metricName string, labels prometheus.Labels, help
 			Help:        help,
 			ConstLabels: labels,
 		})
-		if err := prometheus.Register(counter); err != nil {
+		if err := c.registerer.Register(counter); err != nil {
 			return nil, err
 		}
 		c.Elements[hash] = counter
@@ -89,12 +94,14 @@ func (c *CounterContainer) Get(metricName string, labels prometheus.Labels, help
 }
 
 type GaugeContainer struct {
-	Elements map[uint64]prometheus.Gauge
+	Elements   map[uint64]prometheus.Gauge
+	registerer prometheus.Registerer
 }
 
-func NewGaugeContainer() *GaugeContainer {
+func NewGaugeContainer(registerer prometheus.Registerer) *GaugeContainer {
 	return &GaugeContainer{
-		Elements: make(map[uint64]prometheus.Gauge),
+		Elements:   make(map[uint64]prometheus.Gauge),
+		registerer: registerer,
 	}
 }
 
@@ -107,7 +114,7 @@ func (c *GaugeContainer) Get(metricName string, labels prometheus.Labels, help s
 			Help:        help,
 			ConstLabels: labels,
 		})
-		if err := prometheus.Register(gauge); err != nil {
+		if err := c.registerer.Register(gauge); err != nil {
 			return nil, err
 		}
 		c.Elements[hash] = gauge
@@ -116,27 +123,32 @@ func (c *GaugeContainer) Get(metricName string, labels prometheus.Labels, help s
 }
 
 type SummaryContainer struct {
-	Elements map[uint64]prometheus.Summary
-	mapper   *metricMapper
+	Elements   map[uint64]prometheus.Summary
+	registerer prometheus.Registerer
 }
 
-func NewSummaryContainer(mapper *metricMapper) *SummaryContainer {
+func NewSummaryContainer(registerer prometheus.Registerer) *SummaryContainer {
 	return &SummaryContainer{
-		Elements: make(map[uint64]prometheus.Summary),
-		mapper:   mapper,
+		Elements:   make(map[uint64]prometheus.Summary),
+		registerer: registerer,
 	}
 }
 
+// quantiles returns the quantiles for summaries created for mapping. Mappings
+// carry the defaults of their file.
+func (c *SummaryContainer) quantiles(mapping *metricMapping) []metricObjective {
+	if mapping != nil && len(mapping.Quantiles) > 0 {
+		return mapping.Quantiles
+	}
+	return defaultQuantiles
+}
+
 func (c *SummaryContainer) Get(metricName string, labels prometheus.Labels, help string, mapping *metricMapping) (prometheus.Summary, error) {
 	hash := hashNameAndLabels(metricName, labels)
 	summary, ok := c.Elements[hash]
 	if !ok {
-		quantiles := c.mapper.Defaults.Quantiles
-		if mapping != nil && mapping.Quantiles != nil && len(mapping.Quantiles) > 0 {
-			quantiles = mapping.Quantiles
-		}
 		objectives := make(map[float64]float64)
-		for _, q := range quantiles {
+		for _, q := range c.quantiles(mapping) {
 			objectives[q.Quantile] = q.Error
 		}
 		summary = prometheus.NewSummary(
@@ -146,7 +158,7 @@ func (c *SummaryContainer) Get(metricName string, labels prometheus.Labels, help
 				ConstLabels: labels,
 				Objectives:  objectives,
 			})
-		if err := prometheus.Register(summary); err != nil {
+		if err := c.registerer.Register(summary); err != nil {
 			return nil, err
 		}
 		c.Elements[hash] = summary
@@ -155,36 +167,41 @@ func (c *SummaryContainer) Get(metricName string, labels prometheus.Labels, help
 }
 
 type HistogramContainer struct {
-	Elements map[uint64]prometheus.Histogram
-	mapper   *metricMapper
+	Elements   map[uint64]prometheus.Histogram
+	registerer prometheus.Registerer
 }
 
-func NewHistogramContainer(mapper *metricMapper) *HistogramContainer {
+func NewHistogramContainer(registerer prometheus.Registerer) *HistogramContainer {
 	return &HistogramContainer{
-		Elements: make(map[uint64]prometheus.Histogram),
-		mapper:   mapper,
+		Elements:   make(map[uint64]prometheus.Histogram),
+		registerer: registerer,
 	}
 }
 
+// buckets returns the buckets for histograms created for mapping. Mappings
+// carry the defaults of their file.
+func (c *HistogramContainer) buckets(mapping *metricMapping) []float64 {
+	if mapping != nil && len(mapping.Buckets) > 0 {
+		return mapping.Buckets
+	}
+	return prometheus.DefBuckets
+}
+
 func (c *HistogramContainer) Get(metricName string, labels prometheus.Labels, help string, mapping *metricMapping) (prometheus.Histogram, error) {
 	hash := hashNameAndLabels(metricName, labels)
 	histogram, ok := c.Elements[hash]
 	if !ok {
-		buckets := c.mapper.Defaults.Buckets
-		if mapping != nil && mapping.Buckets != nil && len(mapping.Buckets) > 0 {
-			buckets = mapping.Buckets
-		}
 		histogram = prometheus.NewHistogram(
 			prometheus.HistogramOpts{
 				Name:        metricName,
 				Help:        help,
 				ConstLabels: labels,
-				Buckets:     buckets,
+				Buckets:     c.buckets(mapping),
 			})
-		c.Elements[hash] = histogram
-		if err := prometheus.Register(histogram); err != nil {
+		if err := c.registerer.Register(histogram); err != nil {
 			return nil, err
 		}
+		c.Elements[hash] = histogram
 	}
 	return histogram, nil
 }
@@ -230,6 +247,13 @@ func (t *TimerEvent) Value() float64            { return t.value }
 func (c *TimerEvent) Labels() map[string]string { return c.labels }
 func (c *TimerEvent) MetricType() metricType    { return metricTypeTimer }
 
+// DeleteEvent requests the removal of the series the wrapped event would be
+// recorded in. It is sent as a sample with the value "delete", e.g.
+// "foo.bar:delete|g|#job:x".
+type DeleteEvent struct {
+	Event
+}
+
 type Events []Event
 
 type Exporter struct {
@@ -238,6 +262,30 @@ type Exporter struct {
 	Summaries  *SummaryContainer
 	Histograms *HistogramContainer
 	mapper     *metricMapper
+	registry   *exporterRegistry
+	series     map[uint64]*seriesInfo
+	// unmappedNames counts the series of unmapped metrics by name.
+	unmappedNames map[string]int
+	// seriesByName and seriesByMapping count the series per metric name and
+	// per mapping identity, for the series limits.
+	seriesByName    map[string]int
+	seriesByMapping map[string]int
+	cardinality     *cardinalityTracker
+	// lru orders the hashes of the series from the most to the least
+	// recently updated. Beyond maxSeries series, the least recently updated
+	// ones are evicted.
+	lru       *list.List
+	maxSeries int
+	// expiring holds the hashes of the series with a TTL, in one list per TTL
+	// ordered like lru, so that expiry only looks at the oldest series of
+	// each. Expired series are removed every expiryInterval, starting with
+	// the first series with a TTL; 0 disables expiry.
+	expiring       map[time.Duration]*list.List
+	expiryInterval time.Duration
+	expiryOnce     sync.Once
+	// deleteLines enables the deletion of series by StatsD lines.
+	deleteLines bool
+	mutex       sync.Mutex
 }
 
 func escapeMetricName(metricName string) string {
@@ -251,6 +299,23 @@ func escapeMetricName(metricName string) string {
 	return metricName
 }
 
+// mergeLabels combines the DogStatsD tags of an event with the labels produced
+// by its mapping into a new label set. If both define the same label, the
+// mapping label wins unless precedence is labelPrecedenceTags.
+func mergeLabels(tags map[string]string, mapped prometheus.Labels, precedence labelPrecedence) prometheus.Labels {
+	labels := make(prometheus.Labels, len(tags)+len(mapped))
+	for label, value := range tags {
+		labels[label] = value
+	}
+	for label, value := range mapped {
+		if _, ok := labels[label]; ok && precedence == labelPrecedenceTags {
+			continue
+		}
+		labels[label] = value
+	}
+	return labels
+}
+
 func (b *Exporter) Listen(e <-chan Events) {
 	for {
 		events, ok := <-e
@@ -259,137 +324,255 @@ func (b *Exporter) Listen(e <-chan Events) {
 			return
 		}
 		for _, event := range events {
-			var help string
-			metricName := ""
-			prometheusLabels := event.Labels()
+			b.handleEvent(event)
+		}
+	}
+}
 
-			mapping, labels, present := b.mapper.getMapping(event.MetricName(), event.MetricType())
-			if mapping == nil {
-				mapping = &metricMapping{}
-			}
+// outputType returns the Prometheus metric type an event is recorded as. If
+// the mapping does not set one, it follows from the StatsD type of the event.
+func (b *Exporter) outputType(event Event, mapping *metricMapping) outputType {
+	if mapping.OutputType != outputTypeDefault {
+		return mapping.OutputType
+	}
 
-			if mapping.Action == actionTypeDrop {
-				continue
-			}
+	switch event.MetricType() {
+	case metricTypeCounter:
+		return outputTypeCounter
+	case metricTypeGauge:
+		return outputTypeGauge
+	case metricTypeTimer:
+		switch t := mapping.TimerType; t {
+		case timerTypeHistogram:
+			return outputTypeHistogram
+		case timerTypeDefault, timerTypeSummary:
+			return outputTypeSummary
+		default:
+			panic(fmt.Sprintf("unknown timer type '%s'", t))
+		}
+	default:
+		panic(fmt.Sprintf("unknown metric type '%s'", event.MetricType()))
+	}
+}
 
-			if mapping.HelpText == "" {
-				help = defaultHelp
-			} else {
-				help = mapping.HelpText
-			}
-			if present {
-				metricName = escapeMetricName(mapping.Name)
-				for label, value := range labels {
-					prometheusLabels[label] = value
-				}
-			} else {
-				eventsUnmapped.Inc()
-				metricName = escapeMetricName(event.MetricName())
-			}
+// timerValue converts a timer value from the unit configured for its mapping
+// to seconds, which is what Prometheus presumes. In legacy mode, summaries
+// are observed in milliseconds instead.
+func (b *Exporter) timerValue(value float64, mapping *metricMapping, t outputType) float64 {
+	value *= mapping.TimerUnit.seconds()
+	if t == outputTypeSummary && mapping.legacySummary {
+		value *= 1000
+	}
+	return value
+}
 
-			switch ev := event.(type) {
-			case *CounterEvent:
-				// We don't accept negative values for counters. Incrementing the counter with a negative number
-				// will cause the exporter to panic. Instead we will warn and continue to the next event.
-				if event.Value() < 0.0 {
-					log.Debugf("Counter %q is: '%f' (counter must be non-negative value)", metricName, event.Value())
-					eventStats.WithLabelValues("illegal_negative_counter").Inc()
-					continue
-				}
+// mappedEvent describes the Prometheus series a StatsD event is recorded in.
+type mappedEvent struct {
+	mapping    *metricMapping
+	present    bool
+	name       string
+	labels     prometheus.Labels
+	help       string
+	outputType outputType
+	// neutralised is set if high-cardinality labels of the event were
+	// neutralised, and overflow if the event was folded into the overflow
+	// series of its metric by a series limit.
+	neutralised bool
+	overflow    bool
+}
 
-				counter, err := b.Counters.Get(
-					metricName,
-					prometheusLabels,
-					help,
-				)
-				if err == nil {
-					counter.Add(event.Value())
-
-					eventStats.WithLabelValues("counter").Inc()
-				} else {
-					log.Debugf(regErrF, metricName, err)
-					conflictingEventStats.WithLabelValues("counter").Inc()
-				}
+// mapEvent applies the mapping configuration to an event. It returns false if
+// the event is dropped by its mapping or the unmapped policy, in which case
+// only the mapping is set.
+func (b *Exporter) mapEvent(event Event) (*mappedEvent, bool) {
+	mapping, labels, present := b.mapper.getMapping(event.MetricName(), event.MetricType(), event.Labels())
+	if mapping == nil {
+		mapping = b.mapper.defaultMapping()
+	}
 
-			case *GaugeEvent:
-				gauge, err := b.Gauges.Get(
-					metricName,
-					prometheusLabels,
-					help,
-				)
-
-				if err == nil {
-					if ev.relative {
-						gauge.Add(event.Value())
-					} else {
-						gauge.Set(event.Value())
-					}
+	if mapping.Action == actionTypeDrop {
+		return &mappedEvent{mapping: mapping, present: present}, false
+	}
 
-					eventStats.WithLabelValues("gauge").Inc()
-				} else {
-					log.Debugf(regErrF, metricName, err)
-					conflictingEventStats.WithLabelValues("gauge").Inc()
-				}
+	m := &mappedEvent{
+		mapping: mapping,
+		present: present,
+		help:    defaultHelp,
+	}
+	if mapping.HelpText != "" {
+		m.help = mapping.HelpText
+	}
+	if present {
+		m.name = escapeMetricName(mapping.Name)
+		m.labels = mergeLabels(event.Labels(), labels, mapping.LabelPrecedence)
+		m.labels = relabel(m.labels, mapping.Relabel)
+	} else {
+		policy := b.mapper.unmappedPolicy()
+		if !policy.allows(event.MetricName()) {
+			return m, false
+		}
+		m.name = policy.name(event.MetricName())
+		m.labels = policy.labels(event.Labels())
+	}
+	m.labels = relabel(m.labels, b.mapper.globalRelabelConfigs())
+	m.outputType = b.outputType(event, mapping)
+	return m, true
+}
 
-			case *TimerEvent:
-				t := timerTypeDefault
-				if mapping != nil {
-					t = mapping.TimerType
-				}
-				if t == timerTypeDefault {
-					t = b.mapper.Defaults.TimerType
-				}
+// handleEvent maps a single StatsD event and records it in the corresponding
+// Prometheus metric.
+func (b *Exporter) handleEvent(event Event) {
+	relative := false
+	switch ev := event.(type) {
+	case *CounterEvent, *TimerEvent:
+	case *GaugeEvent:
+		relative = ev.relative
+	case *DeleteEvent:
+		b.handleDelete(ev)
+		return
+	default:
+		log.Debugln("Unsupported event type")
+		eventStats.WithLabelValues("illegal").Inc()
+		return
+	}
+	eventType := string(event.MetricType())
 
-				switch t {
-				case timerTypeHistogram:
-					histogram, err := b.Histograms.Get(
-						metricName,
-						prometheusLabels,
-						help,
-						mapping,
-					)
-					if err == nil {
-						histogram.Observe(event.Value() / 1000) // prometheus presumes seconds, statsd millisecond
-						eventStats.WithLabelValues("timer").Inc()
-					} else {
-						log.Debugf(regErrF, metricName, err)
-						conflictingEventStats.WithLabelValues("timer").Inc()
-					}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-				case timerTypeDefault, timerTypeSummary:
-					summary, err := b.Summaries.Get(
-						metricName,
-						prometheusLabels,
-						help,
-						mapping,
-					)
-					if err == nil {
-						summary.Observe(event.Value())
-						eventStats.WithLabelValues("timer").Inc()
-					} else {
-						log.Debugf(regErrF, metricName, err)
-						conflictingEventStats.WithLabelValues("timer").Inc()
-					}
+	m, ok := b.mapEvent(event)
+	if m.present {
+		m.mapping.recordHit()
+	} else {
+		eventsUnmapped.Inc()
+		eventsUnmappedByType.WithLabelValues(eventType).Inc()
+	}
+	if !ok {
+		if m.present {
+			m.mapping.recordDrop()
+		} else {
+			eventsUnmappedDropped.Inc()
+		}
+		return
+	}
+	mapping, metricName, prometheusLabels, help := m.mapping, m.name, m.labels, m.help
 
-				default:
-					panic(fmt.Sprintf("unknown timer type '%s'", t))
-				}
+	value, ok := mapping.transformValue(event.Value(), relative)
+	if !ok {
+		log.Debugf("Value %f for %q is out of bounds of its mapping, dropping it", value, metricName)
+		return
+	}
+
+	t := m.outputType
+	if event.MetricType() == metricTypeTimer {
+		value = b.timerValue(value, mapping, t)
+	}
+
+	b.neutraliseLabels(m)
+	if !b.limitSeries(m) {
+		return
+	}
+	prometheusLabels = m.labels
+
+	switch t {
+	case outputTypeCounter:
+		// We don't accept negative values for counters. Incrementing the counter with a negative number
+		// will cause the exporter to panic. Instead we will warn and continue to the next event.
+		if value < 0.0 {
+			log.Debugf("Counter %q is: '%f' (counter must be non-negative value)", metricName, value)
+			eventStats.WithLabelValues("illegal_negative_counter").Inc()
+			return
+		}
+
+		counter, err := b.Counters.Get(
+			metricName,
+			prometheusLabels,
+			help,
+		)
+		if err == nil {
+			b.recordSeries(event, m, counter)
+			counter.Add(value)
+
+			eventStats.WithLabelValues(eventType).Inc()
+		} else {
+			log.Debugf(regErrF, metricName, err)
+			conflictingEventStats.WithLabelValues(eventType).Inc()
+		}
 
-			default:
-				log.Debugln("Unsupported event type")
-				eventStats.WithLabelValues("illegal").Inc()
+	case outputTypeGauge:
+		gauge, err := b.Gauges.Get(
+			metricName,
+			prometheusLabels,
+			help,
+		)
+
+		if err == nil {
+			b.recordSeries(event, m, gauge)
+			if relative {
+				gauge.Add(value)
+			} else {
+				gauge.Set(value)
 			}
+
+			eventStats.WithLabelValues(eventType).Inc()
+		} else {
+			log.Debugf(regErrF, metricName, err)
+			conflictingEventStats.WithLabelValues(eventType).Inc()
+		}
+
+	case outputTypeHistogram:
+		histogram, err := b.Histograms.Get(
+			metricName,
+			prometheusLabels,
+			help,
+			mapping,
+		)
+		if err == nil {
+			b.recordSeries(event, m, histogram)
+			histogram.Observe(value)
+			eventStats.WithLabelValues(eventType).Inc()
+		} else {
+			log.Debugf(regErrF, metricName, err)
+			conflictingEventStats.WithLabelValues(eventType).Inc()
+		}
+
+	case outputTypeSummary:
+		summary, err := b.Summaries.Get(
+			metricName,
+			prometheusLabels,
+			help,
+			mapping,
+		)
+		if err == nil {
+			b.recordSeries(event, m, summary)
+			summary.Observe(value)
+			eventStats.WithLabelValues(eventType).Inc()
+		} else {
+			log.Debugf(regErrF, metricName, err)
+			conflictingEventStats.WithLabelValues(eventType).Inc()
 		}
+
+	default:
+		panic(fmt.Sprintf("unknown output type '%s'", t))
 	}
 }
 
 func NewExporter(mapper *metricMapper) *Exporter {
+	registry := newExporterRegistry()
 	return &Exporter{
-		Counters:   NewCounterContainer(),
-		Gauges:     NewGaugeContainer(),
-		Summaries:  NewSummaryContainer(mapper),
-		Histograms: NewHistogramContainer(mapper),
-		mapper:     mapper,
+		Counters:        NewCounterContainer(registry),
+		Gauges:          NewGaugeContainer(registry),
+		Summaries:       NewSummaryContainer(registry),
+		Histograms:      NewHistogramContainer(registry),
+		mapper:          mapper,
+		registry:        registry,
+		series:          make(map[uint64]*seriesInfo),
+		unmappedNames:   make(map[string]int),
+		seriesByName:    make(map[string]int),
+		seriesByMapping: make(map[string]int),
+		cardinality:     newCardinalityTracker(),
+		lru:             list.New(),
+		expiring:        make(map[time.Duration]*list.List),
 	}
 }
 
@@ -477,8 +660,9 @@ samples:
 			relative = true
 		}
 
+		deletion := valueStr == "delete"
 		value, err := strconv.ParseFloat(valueStr, 64)
-		if err != nil {
+		if err != nil && !deletion {
 			log.Debugf("Bad value %s on line: %s", valueStr, line)
 			sampleErrors.WithLabelValues("malformed_value").Inc()
 			continue
@@ -534,6 +718,9 @@ samples:
 				sampleErrors.WithLabelValues("illegal_event").Inc()
 				continue
 			}
+			if deletion {
+				event = &DeleteEvent{event}
+			}
 			events = append(events, event)
 		}
 	}
@@ -16,10 +16,14 @@ package main
 import (
 	"fmt"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // TestNegativeCounter validates when we send a negative
@@ -171,3 +175,343 @@ func TestEscapeMetricName(t *testing.T) {
 		}
 	}
 }
+
+func TestOutputTypeConversion(t *testing.T) {
+	mapper := &metricMapper{}
+	err := mapper.initFromYAMLString(`---
+mappings:
+- match: queue.depth
+  name: "queue_depth"
+  output_type: gauge
+- match: request.size
+  name: "request_size_bytes"
+  output_type: histogram
+  buckets: [ 100, 1000 ]
+- match: request.time
+  name: "request_time_seconds_total"
+  output_type: counter
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	events := make(chan Events, 1)
+	events <- Events{
+		&CounterEvent{metricName: "queue.depth", value: 5},
+		&CounterEvent{metricName: "queue.depth", value: 3},
+		&GaugeEvent{metricName: "request.size", value: 500},
+		&TimerEvent{metricName: "request.time", value: 1500},
+		&TimerEvent{metricName: "request.time", value: 500},
+	}
+	close(events)
+
+	ex := NewExporter(mapper)
+	ex.Listen(events)
+
+	gauge, ok := ex.Gauges.Elements[hashNameAndLabels("queue_depth", nil)]
+	if !ok {
+		t.Fatalf("Counter event was not recorded as a gauge")
+	}
+	m := &dto.Metric{}
+	gauge.Write(m)
+	if got := m.GetGauge().GetValue(); got != 3 {
+		t.Fatalf("Expected gauge to hold the last value 3, got %f", got)
+	}
+
+	histogram, ok := ex.Histograms.Elements[hashNameAndLabels("request_size_bytes", nil)]
+	if !ok {
+		t.Fatalf("Gauge event was not recorded as a histogram")
+	}
+	m = &dto.Metric{}
+	histogram.Write(m)
+	if got := m.GetHistogram().GetSampleSum(); got != 500 {
+		t.Fatalf("Expected histogram sum 500, got %f", got)
+	}
+
+	counter, ok := ex.Counters.Elements[hashNameAndLabels("request_time_seconds_total", nil)]
+	if !ok {
+		t.Fatalf("Timer event was not recorded as a counter")
+	}
+	m = &dto.Metric{}
+	counter.Write(m)
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Fatalf("Expected counter of total time 2s, got %f", got)
+	}
+}
+
+func TestTimerUnits(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config string
+		value  float64
+		sum    float64
+	}{
+		{
+			name:  "summary_default_unit",
+			value: 300,
+			sum:   .3,
+		},
+		{
+			name: "summary_legacy_units",
+			config: `
+defaults:
+  legacy_summary_units: true
+`,
+			value: 300,
+			sum:   300,
+		},
+		{
+			name: "summary_global_unit",
+			config: `
+defaults:
+  timer_unit: us
+`,
+			value: 300,
+			sum:   .0003,
+		},
+		{
+			name: "summary_mapping_unit",
+			config: `
+defaults:
+  timer_unit: us
+mappings:
+- match: summary_mapping_unit
+  match_type: regex
+  name: summary_mapping_unit
+  timer_unit: s
+`,
+			value: 3,
+			sum:   3,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		mapper := &metricMapper{}
+		if err := mapper.initFromYAMLString(scenario.config); err != nil {
+			t.Fatalf("%s: Config load error: %s", scenario.name, err)
+		}
+
+		events := make(chan Events, 1)
+		events <- Events{
+			&TimerEvent{metricName: scenario.name, value: scenario.value},
+		}
+		close(events)
+
+		ex := NewExporter(mapper)
+		ex.Listen(events)
+
+		summary, ok := ex.Summaries.Elements[hashNameAndLabels(scenario.name, nil)]
+		if !ok {
+			t.Fatalf("%s: Timer was not recorded as a summary", scenario.name)
+		}
+		m := &dto.Metric{}
+		summary.Write(m)
+		if got := m.GetSummary().GetSampleSum(); got != scenario.sum {
+			t.Fatalf("%s: Expected summary sum %v, got %v", scenario.name, scenario.sum, got)
+		}
+	}
+}
+
+func TestMappingTelemetry(t *testing.T) {
+	// The telemetry is global, so start over in case the test is repeated.
+	for _, id := range []string{"telemetry-timers", "1:telemetry.dropped", "2:telemetry.unused"} {
+		mappingEventsMatched.DeleteLabelValues(id)
+		mappingEventsDropped.DeleteLabelValues(id)
+		mappingLastMatch.DeleteLabelValues(id)
+	}
+
+	mapper := &metricMapper{}
+	err := mapper.initFromYAMLString(`---
+mappings:
+- match: telemetry.*.timer
+  id: telemetry-timers
+  name: "telemetry_timer_seconds"
+- match: telemetry.dropped
+  name: "dropped"
+  action: drop
+- match: telemetry.unused
+  name: "unused"
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+	events := make(chan Events, 1)
+	events <- Events{
+		&TimerEvent{metricName: "telemetry.web.timer", value: 1},
+		&TimerEvent{metricName: "telemetry.api.timer", value: 1},
+		&CounterEvent{metricName: "telemetry.dropped", value: 1},
+	}
+	close(events)
+	ex.Listen(events)
+
+	value := func(c prometheus.Collector) float64 {
+		m := &dto.Metric{}
+		if err := c.(prometheus.Metric).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+	}
+
+	scenarios := []struct {
+		metric   prometheus.Collector
+		expected float64
+	}{
+		{mappingEventsMatched.WithLabelValues("telemetry-timers"), 2},
+		{mappingEventsDropped.WithLabelValues("telemetry-timers"), 0},
+		{mappingEventsMatched.WithLabelValues("1:telemetry.dropped"), 1},
+		{mappingEventsDropped.WithLabelValues("1:telemetry.dropped"), 1},
+		{mappingEventsMatched.WithLabelValues("2:telemetry.unused"), 0},
+		{mappingLastMatch.WithLabelValues("2:telemetry.unused"), 0},
+	}
+	for i, scenario := range scenarios {
+		if got := value(scenario.metric); got != scenario.expected {
+			t.Fatalf("%d. Expected %v, got %v", i, scenario.expected, got)
+		}
+	}
+	if value(mappingLastMatch.WithLabelValues("telemetry-timers")) == 0 {
+		t.Fatalf("Last match of telemetry-timers was not recorded")
+	}
+
+	// Duplicate IDs are rejected.
+	err = mapper.initFromYAMLString(`---
+mappings:
+- match: telemetry.alpha
+  id: telemetry
+  name: "alpha"
+- match: telemetry.beta
+  id: telemetry
+  name: "beta"
+`)
+	if err == nil || !strings.Contains(err.Error(), `mapping 1 (telemetry.beta): id "telemetry" is already used by mapping 0`) {
+		t.Fatalf("Expected duplicate ID error, got %v", err)
+	}
+}
+
+func TestUnmappedPolicy(t *testing.T) {
+	scenarios := []struct {
+		config   string
+		mapped   []string
+		unmapped []string
+		err      string
+	}{
+		{
+			// By default, unmapped metrics are exported along with mapped ones.
+			config: "",
+			mapped: []string{"mapped_total", "other_metric", "unmapped_metric"},
+		},
+		{
+			config: "unmapped:\n  action: drop\n",
+			mapped: []string{"mapped_total"},
+		},
+		{
+			config: "unmapped:\n  prefix: statsd_\n  labels:\n    unmapped: \"true\"\n",
+			mapped: []string{
+				`mapped_total`,
+				`statsd_other_metric{unmapped="true"}`,
+				`statsd_unmapped_metric{unmapped="true"}`,
+			},
+		},
+		{
+			config: "unmapped:\n  allow_prefixes: [unmapped.]\n",
+			mapped: []string{"mapped_total", "unmapped_metric"},
+		},
+		{
+			config:   "unmapped:\n  separate_path: true\n",
+			mapped:   []string{"mapped_total"},
+			unmapped: []string{"other_metric", "unmapped_metric"},
+		},
+		{
+			config: "unmapped:\n  prefix: 0statsd\n",
+			err:    "invalid unmapped metric prefix: 0statsd",
+		},
+		{
+			config: "unmapped:\n  labels:\n    0bad: \"true\"\n",
+			err:    "invalid unmapped metric label key: 0bad",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mapper := &metricMapper{}
+		err := mapper.initFromYAMLString("mappings:\n- match: mapped.*\n  name: mapped_total\n" + scenario.config)
+		if scenario.err != "" {
+			if err == nil || !strings.Contains(err.Error(), scenario.err) {
+				t.Fatalf("%d. Expected error %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. Config load error: %s", i, err)
+		}
+
+		ex := NewExporter(mapper)
+		events := make(chan Events, 1)
+		events <- Events{
+			&CounterEvent{metricName: "mapped.alpha", value: 1},
+			&CounterEvent{metricName: "unmapped.metric", value: 1},
+			&GaugeEvent{metricName: "other.metric", value: 1},
+		}
+		close(events)
+		ex.Listen(events)
+
+		if got := gatherSeries(t, ex.gatherer(false)); !reflect.DeepEqual(got, scenario.mapped) {
+			t.Fatalf("%d. Expected mapped series %v, got %v", i, scenario.mapped, got)
+		}
+		if got := gatherSeries(t, ex.gatherer(true)); !reflect.DeepEqual(got, scenario.unmapped) {
+			t.Fatalf("%d. Expected unmapped series %v, got %v", i, scenario.unmapped, got)
+		}
+	}
+}
+
+// gatherSeries returns the sorted series of a gatherer in a name{labels}
+// notation.
+func gatherSeries(t *testing.T, g prometheus.Gatherer) []string {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make([]string, 0, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+			}
+			s := mf.GetName()
+			if len(labels) > 0 {
+				s += "{" + strings.Join(labels, ",") + "}"
+			}
+			series = append(series, s)
+		}
+	}
+	sort.Strings(series)
+	return series
+}
+
+// TestOwnMetricCollision checks that events colliding with the exporter's own
+// metrics are counted as conflicts instead of breaking the scrape.
+func TestOwnMetricCollision(t *testing.T) {
+	ex := NewExporter(&metricMapper{})
+	before := conflicts(t, "gauge")
+
+	c := make(chan Events, 1)
+	c <- Events{&GaugeEvent{metricName: "statsd_exporter_loaded_mappings", value: 42}}
+	close(c)
+	ex.Listen(c)
+
+	if got := conflicts(t, "gauge") - before; got != 1 {
+		t.Fatalf("Expected 1 conflict, got %v", got)
+	}
+	if got := gatherSeries(t, ex.gatherer(false)); len(got) != 0 {
+		t.Fatalf("Expected no series, got %v", got)
+	}
+	if _, err := (prometheus.Gatherers{prometheus.DefaultGatherer, ex.gatherer(false)}).Gather(); err != nil {
+		t.Fatalf("Expected the metrics to be gathered without errors, got %s", err)
+	}
+
+	for _, name := range []string{"statsd_exporter_build_info", "statsd_exporter_series_over_limit_total", "go_goroutines", "process_cpu_seconds_total"} {
+		if !reservedNames[name] {
+			t.Fatalf("Expected %s to be reserved", name)
+		}
+	}
+}
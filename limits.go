@@ -0,0 +1,141 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// overflowLabelValue replaces all label values of series folded into the
+// overflow series of their metric.
+const overflowLabelValue = "__overflow__"
+
+type limitAction string
+
+const (
+	limitActionDrop     limitAction = "drop"
+	limitActionOverflow limitAction = "overflow"
+	limitActionDefault  limitAction = ""
+)
+
+func (a *limitAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch limitAction(v) {
+	case limitActionDrop, limitActionOverflow, limitActionDefault:
+		*a = limitAction(v)
+	default:
+		return fmt.Errorf("invalid limit action %q", v)
+	}
+	return nil
+}
+
+// seriesLimits caps the number of series the exporter creates. A limit of 0
+// means no limit.
+type seriesLimits struct {
+	// MaxSeriesPerMetric limits the number of label sets per metric name.
+	MaxSeriesPerMetric int `yaml:"max_series_per_metric"`
+	// MaxSeries limits the number of series in total, or per mapping for the
+	// limits of a mapping.
+	MaxSeries int         `yaml:"max_series"`
+	Action    limitAction `yaml:"action"`
+}
+
+func (l *seriesLimits) validate() error {
+	if l.MaxSeriesPerMetric < 0 {
+		return fmt.Errorf("max_series_per_metric must not be negative")
+	}
+	if l.MaxSeries < 0 {
+		return fmt.Errorf("max_series must not be negative")
+	}
+	return nil
+}
+
+// exceeded reports whether a limit is reached by the given number of series.
+func exceeded(limit, series int) bool {
+	return limit > 0 && series >= limit
+}
+
+// overflowLabels returns labels with all values replaced by the overflow value.
+func overflowLabels(labels prometheus.Labels) prometheus.Labels {
+	overflow := make(prometheus.Labels, len(labels))
+	for k := range labels {
+		overflow[k] = overflowLabelValue
+	}
+	return overflow
+}
+
+// limitSeries applies the global limits and those of the event's mapping
+// before a new series is created. It returns false if the event is dropped. If
+// the event is folded into the overflow series of its metric instead, the
+// labels of m are changed accordingly. The overflow series itself is exempt
+// from the limits, so there is at most one beyond them per metric name.
+func (b *Exporter) limitSeries(m *mappedEvent) bool {
+	if _, ok := b.series[hashNameAndLabels(m.name, m.labels)]; ok {
+		return true
+	}
+
+	global := b.mapper.seriesLimits()
+	var local seriesLimits
+	if m.present {
+		local = m.mapping.Limits
+	}
+
+	var limit string
+	switch {
+	case exceeded(global.MaxSeries, len(b.series)):
+		limit = "total"
+	case exceeded(global.MaxSeriesPerMetric, b.seriesByName[m.name]),
+		exceeded(local.MaxSeriesPerMetric, b.seriesByName[m.name]):
+		limit = "metric"
+	case m.present && exceeded(local.MaxSeries, b.seriesByMapping[m.mapping.identity()]):
+		limit = "mapping"
+	default:
+		return true
+	}
+
+	action := local.Action
+	if action == limitActionDefault {
+		action = global.Action
+	}
+	if action == limitActionOverflow && len(m.labels) > 0 {
+		m.labels = overflowLabels(m.labels)
+		m.overflow = true
+		if _, ok := b.series[hashNameAndLabels(m.name, m.labels)]; !ok {
+			log.Infof("Series limit (%s) reached for %q, folding new series into its overflow series", limit, m.name)
+		}
+	} else {
+		action = limitActionDrop
+		log.Debugf("Series limit (%s) reached for %q, dropping new series", limit, m.name)
+	}
+
+	// Only name the metric for the per-metric limit, which it can only
+	// reach with existing series, so that junk names don't make the
+	// telemetry grow without bound.
+	mapping, metric := "unmapped", ""
+	if m.present {
+		mapping = m.mapping.identity()
+	}
+	if limit == "metric" {
+		metric = m.name
+	}
+	seriesOverLimit.WithLabelValues(mapping, metric, limit, string(action)).Inc()
+	return action == limitActionOverflow
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSeriesLimits(t *testing.T) {
+	events := Events{
+		&CounterEvent{metricName: "limited.alpha", value: 1, labels: map[string]string{"request": "1"}},
+		&CounterEvent{metricName: "limited.alpha", value: 1, labels: map[string]string{"request": "2"}},
+		&CounterEvent{metricName: "limited.alpha", value: 1, labels: map[string]string{"request": "3"}},
+		&CounterEvent{metricName: "limited.beta", value: 1},
+		&CounterEvent{metricName: "other.metric", value: 1},
+	}
+
+	scenarios := []struct {
+		config   string
+		expected []string
+		err      string
+	}{
+		{
+			config: "",
+			expected: []string{
+				`beta_total`,
+				`limited_total{request="1"}`,
+				`limited_total{request="2"}`,
+				`limited_total{request="3"}`,
+				`other_metric`,
+			},
+		},
+		{
+			config: "limits:\n  max_series_per_metric: 2\n",
+			expected: []string{
+				`beta_total`,
+				`limited_total{request="1"}`,
+				`limited_total{request="2"}`,
+				`other_metric`,
+			},
+		},
+		{
+			config: "limits:\n  max_series_per_metric: 1\n  action: overflow\n",
+			expected: []string{
+				`beta_total`,
+				`limited_total{request="1"}`,
+				`limited_total{request="__overflow__"}`,
+				`other_metric`,
+			},
+		},
+		{
+			// Series without labels can't overflow and are dropped.
+			config: "limits:\n  max_series: 2\n  action: overflow\n",
+			expected: []string{
+				`limited_total{request="1"}`,
+				`limited_total{request="2"}`,
+				`limited_total{request="__overflow__"}`,
+			},
+		},
+		{
+			config: "limits:\n  max_series: 10\n  action: overflow\n" + `
+mappings:
+- match: limited.alpha
+  name: limited_total
+  limits:
+    max_series_per_metric: 2
+    action: drop
+- match: limited.beta
+  name: beta_total
+`,
+			expected: []string{
+				`beta_total`,
+				`limited_total{request="1"}`,
+				`limited_total{request="2"}`,
+				`other_metric`,
+			},
+		},
+		{
+			// The limit of a mapping covers all metrics it creates.
+			config: `
+mappings:
+- match: limited.*
+  name: limited_${1}_total
+  limits:
+    max_series: 2
+`,
+			expected: []string{
+				`limited_alpha_total{request="1"}`,
+				`limited_alpha_total{request="2"}`,
+				`other_metric`,
+			},
+		},
+		{
+			config: "limits:\n  max_series: -1\n",
+			err:    "limits: max_series must not be negative",
+		},
+		{
+			config: "limits:\n  action: truncate\n",
+			err:    `invalid limit action "truncate"`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		config := scenario.config
+		if !strings.Contains(config, "mappings:") {
+			config += "mappings:\n- match: limited.alpha\n  name: limited_total\n- match: limited.beta\n  name: beta_total\n"
+		}
+		mapper := &metricMapper{}
+		err := mapper.initFromYAMLString(config)
+		if scenario.err != "" {
+			if err == nil || !strings.Contains(err.Error(), scenario.err) {
+				t.Fatalf("%d. Expected error %q, got %v", i, scenario.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. Config load error: %s", i, err)
+		}
+
+		ex := NewExporter(mapper)
+		c := make(chan Events, 1)
+		c <- events
+		close(c)
+		ex.Listen(c)
+
+		if got := gatherSeries(t, ex.gatherer(false)); !reflect.DeepEqual(got, scenario.expected) {
+			t.Fatalf("%d. Expected series %v, got %v", i, scenario.expected, got)
+		}
+	}
+}
+
+func TestSeriesLimitTelemetry(t *testing.T) {
+	mapper := &metricMapper{}
+	err := mapper.initFromYAMLString(`---
+limits:
+  max_series_per_metric: 1
+  max_series: 2
+mappings:
+- match: limited.alpha
+  name: limited_total
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+	events := Events{
+		&CounterEvent{metricName: "limited.alpha", value: 1, labels: map[string]string{"request": "1"}},
+		&CounterEvent{metricName: "limited.alpha", value: 1, labels: map[string]string{"request": "2"}},
+		&CounterEvent{metricName: "junk.a0", value: 1},
+	}
+	for i := 1; i <= 4; i++ {
+		events = append(events, &CounterEvent{metricName: fmt.Sprintf("junk.a%d", i), value: 1})
+	}
+
+	seriesOverLimit.Reset()
+	c := make(chan Events, 1)
+	c <- events
+	close(c)
+	ex.Listen(c)
+
+	ch := make(chan prometheus.Metric, 10)
+	seriesOverLimit.Collect(ch)
+	close(ch)
+	var got []string
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		labels := []string{}
+		for _, lp := range m.GetLabel() {
+			labels = append(labels, lp.GetName()+"="+lp.GetValue())
+		}
+		got = append(got, fmt.Sprintf("%s %v", strings.Join(labels, ","), m.GetCounter().GetValue()))
+	}
+	sort.Strings(got)
+
+	// The junk names beyond the total limit share a single series.
+	expected := []string{
+		"action=drop,limit=metric,mapping=0:limited.alpha,metric=limited_total 1",
+		"action=drop,limit=total,mapping=unmapped,metric= 4",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected over limit telemetry %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var lintMetricTypes = []metricType{metricTypeCounter, metricTypeGauge, metricTypeTimer}
+
+// lintMappings looks for mappings that are valid on their own, but never
+// take effect or produce conflicting metrics. The problems found are
+// returned as messages.
+func lintMappings(mappings []metricMapping) []string {
+	var problems []string
+	problems = append(problems, lintUnreachable(mappings)...)
+	problems = append(problems, lintReferences(mappings)...)
+	problems = append(problems, lintLabelConflicts(mappings)...)
+	return problems
+}
+
+func describeMapping(mappings []metricMapping, i int) string {
+	return fmt.Sprintf("mapping %d (%s)", i, mappings[i].Match)
+}
+
+// shadows reports whether every metric matched by the glob mapping b is
+// matched by the earlier glob mapping a as well, disregarding metric types.
+// Wildcards also match the literal "*", so this is the case if a regex of a
+// matches each of b's globs. As "**" in b stands for one or more components,
+// a has to match it both as a single and as multiple components.
+func shadows(a, b *metricMapping) bool {
+	if a.MatchType != matchTypeGlob || b.MatchType != matchTypeGlob {
+		return false
+	}
+	// Mappings that match on tags or whose name is a template may pass
+	// metrics on to later mappings.
+	if len(a.labelRegexes) > 0 || a.nameTemplate != nil || matchReferenceRE.ReplaceAllString(a.Name, "") == "" {
+		return false
+	}
+	for _, match := range b.Match {
+		if !globShadows(a, match) {
+			return false
+		}
+	}
+	return true
+}
+
+// globShadows reports whether any pattern of a matches all metrics the glob
+// match does.
+func globShadows(a *metricMapping, match string) bool {
+	for _, regex := range a.regexes {
+		if !strings.Contains(match, "**") {
+			if regex.MatchString(match) {
+				return true
+			}
+			continue
+		}
+		if regex.MatchString(strings.Replace(match, "**", "*", -1)) && regex.MatchString(strings.Replace(match, "**", "*.*", -1)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lintUnreachable reports glob mappings that never match, as earlier glob
+// mappings match all of their metrics for all metric types they apply to.
+func lintUnreachable(mappings []metricMapping) []string {
+	var problems []string
+	for j := range mappings {
+		b := &mappings[j]
+		types := lintMetricTypes
+		if len(b.MatchMetricType) > 0 {
+			types = b.MatchMetricType
+		}
+
+		shadowedBy := -1
+		coveredBy := map[metricType]int{}
+		for i := 0; i < j && shadowedBy < 0; i++ {
+			a := &mappings[i]
+			if !shadows(a, b) {
+				continue
+			}
+			if len(a.MatchMetricType) == 0 {
+				shadowedBy = i
+				continue
+			}
+			for _, t := range a.MatchMetricType {
+				if _, ok := coveredBy[t]; !ok {
+					coveredBy[t] = i
+				}
+			}
+		}
+
+		if shadowedBy >= 0 {
+			problems = append(problems, fmt.Sprintf("%s is shadowed by the broader %s", describeMapping(mappings, j), describeMapping(mappings, shadowedBy)))
+			continue
+		}
+		var covers []string
+		for _, t := range types {
+			if i, ok := coveredBy[t]; ok {
+				covers = append(covers, fmt.Sprintf("%s events by %s", t, describeMapping(mappings, i)))
+			}
+		}
+		if len(covers) == len(types) {
+			problems = append(problems, fmt.Sprintf("%s never fires, all of its metrics are matched earlier: %s", describeMapping(mappings, j), strings.Join(covers, ", ")))
+		}
+	}
+	return problems
+}
+
+// lintReferences reports $n references in names and labels beyond the
+// number of capture groups, and ${name} references to capture groups that
+// don't exist. Both always expand to an empty string.
+func lintReferences(mappings []metricMapping) []string {
+	var problems []string
+	for i := range mappings {
+		m := &mappings[i]
+		for j, regex := range m.regexes {
+			// Name patterns only if there are several of them.
+			desc := describeMapping(mappings, i)
+			if len(m.regexes) > 1 {
+				desc = fmt.Sprintf("mapping %d pattern %s", i, m.Match[j])
+			}
+			groups := regex.NumSubexp()
+			names := map[string]bool{}
+			for _, name := range regex.SubexpNames() {
+				names[name] = name != ""
+			}
+
+			check := func(field, expr string) {
+				for _, ref := range matchReferenceRE.FindAllStringSubmatch(expr, -1) {
+					if n, err := strconv.Atoi(ref[1]); err == nil && n > groups {
+						problems = append(problems, fmt.Sprintf("%s references %s in %s, but only has %d capture groups", desc, ref[0], field, groups))
+					}
+				}
+				for _, ref := range namedReferenceRE.FindAllStringSubmatch(expr, -1) {
+					if !names[ref[1]] {
+						problems = append(problems, fmt.Sprintf("%s references %s in %s, but has no capture group named %s", desc, ref[0], field, ref[1]))
+					}
+				}
+			}
+			check("name", m.Name)
+			for _, k := range labelNames(m.Labels) {
+				check("label "+k, m.Labels[k])
+			}
+		}
+	}
+	return problems
+}
+
+// lintLabelConflicts reports mappings producing the same metric name with
+// different sets of label names. Only the first of them can be registered,
+// events for the others are counted as conflicts.
+func lintLabelConflicts(mappings []metricMapping) []string {
+	var problems []string
+	first := map[string]int{}
+	for i := range mappings {
+		m := &mappings[i]
+		if m.Action == actionTypeDrop || m.nameTemplate != nil || strings.Contains(m.Name, "$") {
+			continue
+		}
+		j, ok := first[m.Name]
+		if !ok {
+			first[m.Name] = i
+			continue
+		}
+		if a, b := labelNames(mappings[j].Labels), labelNames(m.Labels); !reflect.DeepEqual(a, b) {
+			problems = append(problems, fmt.Sprintf("%s produces %s with labels %v, but %s produces it with labels %v", describeMapping(mappings, i), m.Name, b, describeMapping(mappings, j), a))
+		}
+	}
+	return problems
+}
+
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintMappings(t *testing.T) {
+	scenarios := []struct {
+		config   string
+		problems []string
+	}{
+		{
+			config: `---
+mappings:
+- match: test.web.*
+  name: "test_web"
+- match: test.*.*
+  name: "test_$1"
+- match: test.web.*.foo
+  name: "test_web_foo"
+`,
+		},
+		{
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test_$1"
+- match: test.web.*
+  name: "test_web_$1"
+- match: other.*.*
+  name: "other"
+  match_labels:
+    env: prod
+- match: other.web.*
+  name: "other_web"
+- match: tmpl.*.*
+  name: "{{ if eq $1 \"web\" }}web{{ end }}"
+- match: tmpl.web.*
+  name: "tmpl_web"
+`,
+			problems: []string{
+				"mapping 1 (test.web.*) is shadowed by the broader mapping 0 (test.*.*)",
+			},
+		},
+		{
+			config: `---
+mappings:
+- match: app.*
+  name: "app_$1"
+- match: app.**
+  name: "app"
+- match: app.web.**.requests
+  name: "app_web_requests"
+- match: other.**.requests
+  name: "other_requests"
+- match: other.*.requests
+  name: "other_single_requests"
+`,
+			problems: []string{
+				"mapping 2 (app.web.**.requests) is shadowed by the broader mapping 1 (app.**)",
+				"mapping 4 (other.*.requests) is shadowed by the broader mapping 3 (other.**.requests)",
+			},
+		},
+		{
+			config: `---
+mappings:
+- match: test.*
+  name: "test_counter"
+  match_metric_type: counter
+- match: test.*
+  name: "test_gauge"
+  match_metric_type: gauge
+- match: test.foo
+  name: "test_foo_counter"
+  match_metric_type: counter
+- match: test.bar
+  name: "test_bar"
+- match: test.*
+  name: "test_timer"
+  match_metric_type: timer
+- match: test.baz
+  name: "test_baz"
+`,
+			problems: []string{
+				"mapping 2 (test.foo) never fires, all of its metrics are matched earlier: counter events by mapping 0 (test.*)",
+				"mapping 5 (test.baz) never fires, all of its metrics are matched earlier: counter events by mapping 0 (test.*), gauge events by mapping 1 (test.*), timer events by mapping 4 (test.*)",
+			},
+		},
+		{
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test_$3"
+  labels:
+    first: "$1"
+    third: "${3}"
+- match: test\.(\w+)
+  match_type: regex
+  name: "test_{{ $2 }}"
+- match: named\.(?P<host>\w+)
+  match_type: regex
+  name: "named_${host}_{{ ${hots} }}"
+`,
+			problems: []string{
+				"mapping 0 (test.*.*) references $3 in name, but only has 2 capture groups",
+				"mapping 0 (test.*.*) references ${3} in label third, but only has 2 capture groups",
+				"mapping 1 (test\\.(\\w+)) references $2 in name, but only has 1 capture groups",
+				"mapping 2 (named\\.(?P<host>\\w+)) references ${hots} in name, but has no capture group named hots",
+			},
+		},
+		{
+			config: `---
+mappings:
+- match: test.alpha.*
+  name: "test_total"
+  labels:
+    kind: "$1"
+- match: test.beta.*
+  name: "test_total"
+  labels:
+    kind: "$1"
+- match: test.gamma.*
+  name: "test_total"
+  labels:
+    name: "$1"
+- match: test.delta.*
+  name: "test_total"
+  action: drop
+`,
+			problems: []string{
+				"mapping 2 (test.gamma.*) produces test_total with labels [name], but mapping 0 (test.alpha.*) produces it with labels [kind]",
+			},
+		},
+		{
+			config: `---
+mappings:
+- match: [ legacy.*, app.* ]
+  match_metric_type: [ counter, gauge ]
+  name: "app_$1"
+- match: [ legacy.web, app.web ]
+  match_metric_type: counter
+  name: "app_web"
+- match: [ legacy.api, other.api ]
+  name: "app_api"
+- match: [ legacy.*.errors, app\.(\w+)\.errors ]
+  match_type: regex
+  name: "errors_$1"
+`,
+			problems: []string{
+				"mapping 1 (legacy.web, app.web) never fires, all of its metrics are matched earlier: counter events by mapping 0 (legacy.*, app.*)",
+				"mapping 3 pattern legacy.*.errors references $1 in name, but only has 0 capture groups",
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mapper := &metricMapper{}
+		if err := mapper.initFromYAMLString(scenario.config); err != nil {
+			t.Fatalf("%d. Config load error: %s", i, err)
+		}
+		problems := lintMappings(mapper.Mappings)
+		if !reflect.DeepEqual(problems, scenario.problems) {
+			t.Fatalf("%d. Expected problems %q, got %q", i, scenario.problems, problems)
+		}
+	}
+}
@@ -14,36 +14,96 @@
 package main
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/howeyc/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 )
 
-func init() {
-	prometheus.MustRegister(version.NewCollector("statsd_exporter"))
-}
-
 var (
 	listenAddress       = flag.String("web.listen-address", ":9102", "The address on which to expose the web interface and generated Prometheus metrics.")
 	metricsEndpoint     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	unmappedEndpoint    = flag.String("web.unmapped-telemetry-path", "/unmapped-metrics", "Path under which to expose unmapped metrics, if the unmapped policy sets separate_path.")
 	statsdListenAddress = flag.String("statsd.listen-address", "", "The UDP address on which to receive statsd metric lines. DEPRECATED, use statsd.listen-udp instead.")
 	statsdListenUDP     = flag.String("statsd.listen-udp", ":9125", "The UDP address on which to receive statsd metric lines. \"\" disables it.")
 	statsdListenTCP     = flag.String("statsd.listen-tcp", ":9125", "The TCP address on which to receive statsd metric lines. \"\" disables it.")
-	mappingConfig       = flag.String("statsd.mapping-config", "", "Metric mapping configuration file name.")
+	mappingConfig       = flag.String("statsd.mapping-config", "", "Metric mapping configuration file name, directory or glob pattern.")
+	configReloadDelay   = flag.Duration("statsd.mapping-config-reload-delay", 500*time.Millisecond, "How long to wait for further changes to the mapping configuration before reloading it.")
+	enableLifecycle     = flag.Bool("web.enable-lifecycle", false, "Enable reloading the mapping configuration via HTTP requests.")
+	adminTokenFile      = flag.String("web.admin-token-file", "", "File with the bearer token that authenticates requests to the admin API. The admin API is disabled if empty.")
+	deleteLines         = flag.Bool("statsd.enable-delete-lines", false, "Delete the series a StatsD line with the value \"delete\" would be recorded in.")
+	snapshotFile        = flag.String("statsd.snapshot-file", "", "File to keep a snapshot of counters, gauges and histograms in, to restore them at startup. \"\" disables snapshots.")
+	snapshotInterval    = flag.Duration("statsd.snapshot-interval", time.Minute, "How often to write a snapshot.")
+	maxLiveSeries       = flag.Int("statsd.max-live-series", 0, "Maximum number of series to export. Beyond it, the least recently updated series are evicted. 0 means no limit.")
 	readBuffer          = flag.Int("statsd.read-buffer", 0, "Size (in bytes) of the operating system's transmit read buffer associated with the UDP connection. Please make sure the kernel parameters net.core.rmem_max is set to a value greater than the value specified.")
 	showVersion         = flag.Bool("version", false, "Print version information.")
+	checkConfigOnly     = flag.Bool("check-config", false, "Check the mapping configuration, report all errors and exit.")
+	checkConfigLines    = flag.String("check-config.lines", "", "File with StatsD lines to map with the checked configuration, \"-\" for stdin.")
+	lintConfig          = flag.Bool("lint-config", false, "Report unreachable and conflicting mappings in the mapping configuration and exit.")
+	testMappings        = flag.Bool("test-mappings", false, "Run the mapping unit test files given as arguments and exit.")
+
+	// reloadMtx serializes config reloads triggered by file changes,
+	// signals and HTTP requests.
+	reloadMtx sync.Mutex
 )
 
-func serveHTTP() {
-	http.Handle(*metricsEndpoint, prometheus.Handler())
+// metricsHandler serves the metrics of the given gatherer, instrumented under
+// the given handler name. Unlike prometheus.Handler, it still serves what could
+// be gathered if there are errors.
+func metricsHandler(handlerName string, g prometheus.Gatherer) http.Handler {
+	return prometheus.InstrumentHandler(handlerName, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			log.Errorln("Error gathering metrics:", err)
+		}
+
+		contentType := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(contentType))
+		var enc expfmt.Encoder
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			enc = expfmt.NewEncoder(gz, contentType)
+		} else {
+			enc = expfmt.NewEncoder(w, contentType)
+		}
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				log.Errorln("Error encoding metrics:", err)
+				return
+			}
+		}
+	}))
+}
+
+func serveHTTP(exporter *Exporter, adminToken string) {
+	http.Handle(*metricsEndpoint, metricsHandler("prometheus", prometheus.Gatherers{prometheus.DefaultGatherer, exporter.gatherer(false)}))
+	http.Handle(*unmappedEndpoint, metricsHandler("unmapped", exporter.gatherer(true)))
+	if *enableLifecycle {
+		http.Handle("/-/reload", reloadHandler(*mappingConfig, exporter))
+	}
+	http.Handle("/api/v1/mappings", mappingsHandler(exporter.mapper))
+	http.Handle("/api/v1/match", matchHandler(exporter))
+	if adminToken != "" {
+		http.Handle("/api/v1/series", authenticated(adminToken, deleteSeriesHandler(exporter)))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>StatsD Exporter</title></head>
@@ -96,37 +156,181 @@ func tcpAddrFromString(addr string) *net.TCPAddr {
 	}
 }
 
-func watchConfig(fileName string, mapper *metricMapper) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal(err)
+// configWatchDirs returns the directories to watch for changes to the mapping
+// config at path. Parent directories are watched instead of the files
+// themselves, so that files replaced by renames or atomic symlink swaps, as
+// done for Kubernetes ConfigMaps, are noticed as well. If a config file or
+// directory is a symlink, the directory of its target is watched too.
+func configWatchDirs(path string) []string {
+	var dirs []string
+	if strings.ContainsAny(path, "*?[") {
+		dirs = append(dirs, filepath.Dir(path))
+	} else if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		dirs = append(dirs, path)
+	} else {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+
+	seen := map[string]bool{dirs[0]: true}
+	files, _ := mappingConfigFiles(path)
+	for _, f := range append(files, path) {
+		resolved, err := filepath.EvalSymlinks(f)
+		if err != nil || resolved == f {
+			continue
+		}
+		dir := resolved
+		if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+			dir = filepath.Dir(resolved)
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
 	}
+	return dirs
+}
+
+// reloadConfig reloads the mapping config at path, applies it to the series
+// created by the exporter and updates the config reload telemetry. If the new
+// config is invalid, the old one is kept.
+func reloadConfig(path string, exporter *Exporter) error {
+	reloadMtx.Lock()
+	defer reloadMtx.Unlock()
 
-	err = watcher.WatchFlags(fileName, fsnotify.FSN_MODIFY)
+	if err := exporter.mapper.initFromFile(path); err != nil {
+		log.Errorln("Error reloading config:", err)
+		configLoads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	exporter.reconcile()
+	log.Infoln("Config reloaded successfully")
+	configLoads.WithLabelValues("success").Inc()
+	setConfigMetrics(exporter.mapper)
+	return nil
+}
+
+// reloadHandler reloads the mapping config on POST requests. It responds with
+// the error if the new config is invalid.
+func reloadHandler(path string, exporter *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if path == "" {
+			http.Error(w, "No mapping config configured", http.StatusBadRequest)
+			return
+		}
+
+		log.Infoln("Reload requested via HTTP, attempting reload")
+		if err := reloadConfig(path, exporter); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "Config reloaded successfully")
+	})
+}
+
+// reloadOnSIGHUP reloads the mapping config whenever the process receives a
+// SIGHUP.
+func reloadOnSIGHUP(path string, exporter *Exporter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Infoln("Received SIGHUP, attempting reload")
+		reloadConfig(path, exporter)
+	}
+}
+
+// snapshotOnShutdown writes a snapshot when the process is asked to terminate,
+// then exits.
+func snapshotOnShutdown(path string, exporter *Exporter) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	<-term
+	log.Infoln("Received termination signal, writing snapshot")
+	if err := exporter.writeSnapshot(path); err != nil {
+		log.Errorln("Error writing snapshot:", err)
+		snapshotWrites.WithLabelValues("failure").Inc()
+		os.Exit(1)
+	}
+	snapshotWrites.WithLabelValues("success").Inc()
+	os.Exit(0)
+}
+
+// setConfigMetrics records a successful load of the configuration.
+func setConfigMetrics(mapper *metricMapper) {
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTime.Set(float64(time.Now().Unix()))
+	configInfo.Reset()
+	configInfo.WithLabelValues(mapper.configHash()).Set(1)
+}
+
+// watchConfig watches the directories of the configuration at path and
+// reloads it once its files have not changed for the given delay, until done
+// is closed. The directories are watched by the time it returns, and the
+// returned channel is closed once watching has stopped.
+func watchConfig(path string, exporter *Exporter, delay time.Duration, done <-chan struct{}) <-chan struct{} {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for {
-		select {
-		case ev := <-watcher.Event:
-			log.Infof("Config file changed (%s), attempting reload", ev)
-			err = mapper.initFromFile(fileName)
-			if err != nil {
-				log.Errorln("Error reloading config:", err)
-				configLoads.WithLabelValues("failure").Inc()
-			} else {
-				log.Infoln("Config reloaded successfully")
-				configLoads.WithLabelValues("success").Inc()
+	watchDirs := func() {
+		for _, dir := range configWatchDirs(path) {
+			if err := watcher.WatchFlags(dir, fsnotify.FSN_ALL); err != nil {
+				log.Errorf("Error watching config directory %s: %s", dir, err)
 			}
-			// Re-add the file watcher since it can get lost on some changes. E.g.
-			// saving a file with vim results in a RENAME-MODIFY-DELETE event
-			// sequence, after which the newly written file is no longer watched.
-			_ = watcher.WatchFlags(fileName, fsnotify.FSN_MODIFY)
-		case err := <-watcher.Error:
-			log.Errorln("Error watching config:", err)
 		}
 	}
+	watchDirs()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		// Editors and ConfigMap updates produce bursts of events, so only
+		// reload once things have settled down.
+		var reload <-chan time.Time
+		for {
+			select {
+			case ev := <-watcher.Event:
+				log.Debugf("Config watch event (%s)", ev)
+				reload = time.After(delay)
+			case <-reload:
+				reload = nil
+				// Symlink targets may have changed, so update the watched
+				// directories. Re-adding an existing watch is harmless.
+				watchDirs()
+
+				_, hash, err := readMappingConfig(path)
+				if err == nil && hash == exporter.mapper.configHash() {
+					log.Debugln("Config unchanged, skipping reload")
+					continue
+				}
+				log.Infoln("Config changed, attempting reload")
+				reloadConfig(path, exporter)
+			case err := <-watcher.Error:
+				log.Errorln("Error watching config:", err)
+			case <-done:
+				// The watcher only shuts down once pending events and
+				// errors are taken.
+				go func() {
+					for range watcher.Event {
+					}
+				}()
+				go func() {
+					for range watcher.Error {
+					}
+				}()
+				watcher.Close()
+				return
+			}
+		}
+	}()
+	return stopped
 }
 
 func main() {
@@ -137,6 +341,56 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *testMappings {
+		if flag.NArg() == 0 {
+			log.Fatalln("test-mappings requires at least one test file.")
+		}
+		if !runMappingTests(flag.Args(), os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *lintConfig {
+		if *mappingConfig == "" {
+			log.Fatalln("lint-config requires statsd.mapping-config to be set.")
+		}
+		mapper := &metricMapper{}
+		if err := mapper.initFromFile(*mappingConfig); err != nil {
+			log.Fatalln("Error loading config:", err)
+		}
+		problems := lintMappings(mapper.Mappings)
+		for _, p := range problems {
+			fmt.Fprintln(os.Stdout, p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *checkConfigOnly {
+		if *mappingConfig == "" {
+			log.Fatalln("check-config requires statsd.mapping-config to be set.")
+		}
+		var lines io.Reader
+		switch *checkConfigLines {
+		case "":
+		case "-":
+			lines = os.Stdin
+		default:
+			f, err := os.Open(*checkConfigLines)
+			if err != nil {
+				log.Fatalln("Error opening StatsD lines:", err)
+			}
+			lines = f
+		}
+		if err := checkConfig(*mappingConfig, lines, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *statsdListenAddress != "" {
 		log.Warnln("Warning: statsd.listen-address is DEPRECATED, please use statsd.listen-udp instead.")
 		*statsdListenUDP = *statsdListenAddress
@@ -151,7 +405,42 @@ func main() {
 	log.Infof("Accepting StatsD Traffic: UDP %v, TCP %v", *statsdListenUDP, *statsdListenTCP)
 	log.Infoln("Accepting Prometheus Requests on", *listenAddress)
 
-	go serveHTTP()
+	mapper := &metricMapper{}
+	if *mappingConfig != "" {
+		err := mapper.initFromFile(*mappingConfig)
+		if err != nil {
+			log.Fatal("Error loading config:", err)
+		}
+		setConfigMetrics(mapper)
+	}
+	exporter := NewExporter(mapper)
+	exporter.maxSeries = *maxLiveSeries
+	exporter.deleteLines = *deleteLines
+	exporter.expiryInterval = time.Second
+	if *snapshotFile != "" {
+		restored, err := exporter.restoreSnapshot(*snapshotFile)
+		if err != nil {
+			log.Errorln("Error restoring snapshot:", err)
+		} else {
+			log.Infof("Restored %d series from snapshot %s", restored, *snapshotFile)
+		}
+		go exporter.snapshotEvery(*snapshotFile, *snapshotInterval)
+		go snapshotOnShutdown(*snapshotFile, exporter)
+	}
+	if *mappingConfig != "" {
+		watchConfig(*mappingConfig, exporter, *configReloadDelay, nil)
+		go reloadOnSIGHUP(*mappingConfig, exporter)
+	}
+
+	var adminToken string
+	if *adminTokenFile != "" {
+		token, err := readAdminToken(*adminTokenFile)
+		if err != nil {
+			log.Fatalln("Error reading admin token:", err)
+		}
+		adminToken = token
+	}
+	go serveHTTP(exporter, adminToken)
 
 	events := make(chan Events, 1024)
 	defer close(events)
@@ -186,14 +475,5 @@ func main() {
 		go tl.Listen(events)
 	}
 
-	mapper := &metricMapper{}
-	if *mappingConfig != "" {
-		err := mapper.initFromFile(*mappingConfig)
-		if err != nil {
-			log.Fatal("Error loading config:", err)
-		}
-		go watchConfig(*mappingConfig, mapper)
-	}
-	exporter := NewExporter(mapper)
 	exporter.Listen(events)
 }
@@ -0,0 +1,239 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestReloadHandler(t *testing.T) {
+	f, err := ioutil.TempFile("", "statsd_exporter_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	write := func(contents string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mapper := &metricMapper{}
+	handler := reloadHandler(f.Name(), NewExporter(mapper))
+
+	scenarios := []struct {
+		method   string
+		config   string
+		code     int
+		body     string
+		mappings int
+	}{
+		{
+			method:   "GET",
+			config:   "mappings:\n- match: test.*\n  name: \"foo\"\n",
+			code:     http.StatusMethodNotAllowed,
+			mappings: 0,
+		},
+		{
+			method:   "POST",
+			config:   "mappings:\n- match: test.*\n  name: \"foo\"\n",
+			code:     http.StatusOK,
+			mappings: 1,
+		},
+		{
+			// An invalid config is reported and the old one is kept.
+			method:   "POST",
+			config:   "mappings:\n- match: test.*\n  name: \"0foo\"\n",
+			code:     http.StatusInternalServerError,
+			body:     "mapping 0 (test.*): metric name '0foo'",
+			mappings: 1,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		write(scenario.config)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(scenario.method, "/-/reload", nil))
+
+		if rec.Code != scenario.code {
+			t.Fatalf("%d: Expected status %d, got %d: %s", i, scenario.code, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), scenario.body) {
+			t.Fatalf("%d: Expected body to contain %q, got %q", i, scenario.body, rec.Body.String())
+		}
+		if len(mapper.Mappings) != scenario.mappings {
+			t.Fatalf("%d: Expected %d mappings, got %d", i, scenario.mappings, len(mapper.Mappings))
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	ex := NewExporter(&metricMapper{})
+	events := make(chan Events, 1)
+	events <- Events{
+		&CounterEvent{metricName: "handler_test", value: 1},
+		// Collides with the exporter's own telemetry.
+		&CounterEvent{metricName: "statsd_exporter_build_info", value: 1},
+	}
+	close(events)
+	ex.Listen(events)
+
+	rec := httptest.NewRecorder()
+	metricsHandler("test", prometheus.Gatherers{prometheus.DefaultGatherer, ex.gatherer(false)}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	for _, name := range []string{"handler_test ", "statsd_exporter_build_info{"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Fatalf("Expected metrics to contain %q, got %q", name, rec.Body.String())
+		}
+	}
+}
+
+// writeConfigMapVersion writes a mapping file into a new timestamped
+// directory and atomically points ..data at it, like a Kubernetes ConfigMap
+// volume update.
+func writeConfigMapVersion(t *testing.T, dir, version, contents string) {
+	versionDir := filepath.Join(dir, version)
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, "mapping.yml"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(version, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newConfigMapDir(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "statsd_exporter_configmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resolve the temp dir itself, so that only the ConfigMap symlinks
+	// matter below.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	writeConfigMapVersion(t, dir, "..2018_01_01_00_00_00.1", contents)
+	if err := os.Symlink(filepath.Join("..data", "mapping.yml"), filepath.Join(dir, "mapping.yml")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestConfigWatchDirs(t *testing.T) {
+	dir := newConfigMapDir(t, "mappings: []\n")
+	defer os.RemoveAll(dir)
+	versionDir := filepath.Join(dir, "..2018_01_01_00_00_00.1")
+
+	scenarios := []struct {
+		path     string
+		expected []string
+	}{
+		{
+			// The file's directory, to see ..data being swapped, and the
+			// directory the symlinks currently resolve to.
+			path:     filepath.Join(dir, "mapping.yml"),
+			expected: []string{dir, versionDir},
+		},
+		{
+			path:     dir,
+			expected: []string{dir, versionDir},
+		},
+		{
+			path:     filepath.Join(dir, "*.yml"),
+			expected: []string{dir, versionDir},
+		},
+	}
+	for i, scenario := range scenarios {
+		got := configWatchDirs(scenario.path)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, scenario.expected) {
+			t.Fatalf("%d. Expected watch directories %v, got %v", i, scenario.expected, got)
+		}
+	}
+}
+
+func TestWatchConfigSymlinkSwap(t *testing.T) {
+	dir := newConfigMapDir(t, "mappings:\n- match: test.*\n  name: \"before\"\n")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yml")
+
+	mapper := &metricMapper{}
+	if err := mapper.initFromFile(path); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	reloads := func() float64 {
+		m := &dto.Metric{}
+		if err := configLoads.WithLabelValues("success").Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	initialReloads := reloads()
+	done := make(chan struct{})
+	stopped := watchConfig(path, NewExporter(mapper), 50*time.Millisecond, done)
+	stop := func() {
+		if done != nil {
+			close(done)
+			<-stopped
+			done = nil
+		}
+	}
+	defer stop()
+
+	// Swap in a new version, in several steps, as the kubelet does.
+	writeConfigMapVersion(t, dir, "..2018_01_01_00_01_00.2", "mappings:\n- match: test.*\n  name: \"after\"\n")
+	if err := os.RemoveAll(filepath.Join(dir, "..2018_01_01_00_00_00.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for reloads() == initialReloads {
+		if time.Now().After(deadline) {
+			t.Fatalf("Config was not reloaded after the symlink swap")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// The burst of events is debounced into a single reload.
+	if got := reloads() - initialReloads; got != 1 {
+		t.Fatalf("Expected 1 reload, got %v", got)
+	}
+	if m, _, _ := mapper.getMapping("test.a", metricTypeCounter, nil); m == nil || m.Name != "after" {
+		t.Fatalf("Expected the new version to be loaded, got %v", m)
+	}
+}
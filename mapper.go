@@ -14,44 +14,72 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
 	yaml "gopkg.in/yaml.v2"
 )
 
 var (
 	statsdMetricRE    = `[a-zA-Z_](-?[a-zA-Z0-9_])+`
-	templateReplaceRE = `(\$\{?\d+\}?)`
+	templateReplaceRE = `(\$\{?\d+\}?|\$\{[a-zA-Z_][a-zA-Z0-9_]*\})`
 
-	metricLineRE = regexp.MustCompile(`^(\*\.|` + statsdMetricRE + `\.)+(\*|` + statsdMetricRE + `)$`)
+	metricLineRE = regexp.MustCompile(`^(\*\*?\.|` + statsdMetricRE + `\.)+(\*\*?|` + statsdMetricRE + `)$`)
 	metricNameRE = regexp.MustCompile(`^([a-zA-Z_]|` + templateReplaceRE + `)([a-zA-Z0-9_]|` + templateReplaceRE + `)*$`)
 	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]+$`)
 )
 
 type mapperConfigDefaults struct {
-	TimerType timerType         `yaml:"timer_type"`
-	Buckets   []float64         `yaml:"buckets"`
-	Quantiles []metricObjective `yaml:"quantiles"`
-	MatchType matchType         `yaml:"match_type"`
+	TimerType       timerType         `yaml:"timer_type"`
+	Buckets         []float64         `yaml:"buckets"`
+	Quantiles       []metricObjective `yaml:"quantiles"`
+	MatchType       matchType         `yaml:"match_type"`
+	LabelPrecedence labelPrecedence   `yaml:"label_precedence"`
+	TimerUnit       timerUnit         `yaml:"timer_unit"`
+	LegacySummary   bool              `yaml:"legacy_summary_units"`
+	TTL             time.Duration     `yaml:"ttl"`
+	// NamedGroupsAsLabels turns the named capture groups of regex mappings
+	// into labels.
+	NamedGroupsAsLabels bool `yaml:"named_groups_as_labels"`
 }
 
 type metricMapper struct {
 	Defaults mapperConfigDefaults `yaml:"defaults"`
-	Mappings []metricMapping      `yaml:"mappings"`
-	mutex    sync.Mutex
+	Mappings []metricMapping      `yaml:"-"` // Decoded one at a time.
+	Relabel  []*relabelConfig     `yaml:"relabel"`
+	Unmapped unmappedPolicy       `yaml:"unmapped"`
+	Limits   seriesLimits         `yaml:"limits"`
+	// LabelCardinality configures the neutralisation of high-cardinality
+	// labels.
+	LabelCardinality labelCardinality `yaml:"label_cardinality"`
+	// globalSections lists the sections set in the configuration that only
+	// the first of several files may set.
+	globalSections []string
+	hash           string
+	mutex          sync.Mutex
 }
 
 type matchMetricType string
 
 type metricMapping struct {
-	Match           string `yaml:"match"`
-	Name            string `yaml:"name"`
-	regex           *regexp.Regexp
+	ID              string     `yaml:"id"`
+	Match           stringList `yaml:"match"`
+	Name            string     `yaml:"name"`
+	regexes         []*regexp.Regexp
+	regex           *regexp.Regexp    // The pattern that matched, set by getMapping.
 	Labels          prometheus.Labels `yaml:"labels"`
 	TimerType       timerType         `yaml:"timer_type"`
 	Buckets         []float64         `yaml:"buckets"`
@@ -59,12 +87,41 @@ type metricMapping struct {
 	MatchType       matchType         `yaml:"match_type"`
 	HelpText        string            `yaml:"help"`
 	Action          actionType        `yaml:"action"`
-	MatchMetricType metricType        `yaml:"match_metric_type"`
+	MatchMetricType metricTypeList    `yaml:"match_metric_type"`
+	MatchLabels     map[string]string `yaml:"match_labels"`
+	labelRegexes    map[string]*regexp.Regexp
+	LabelPrecedence labelPrecedence  `yaml:"label_precedence"`
+	Relabel         []*relabelConfig `yaml:"relabel"`
+	nameTemplate    *template.Template
+	labelTemplates  map[string]*template.Template
+	Scale           *float64      `yaml:"scale"`
+	Offset          *float64      `yaml:"offset"`
+	Min             *float64      `yaml:"min"`
+	Max             *float64      `yaml:"max"`
+	OutOfBounds     boundsAction  `yaml:"out_of_bounds"`
+	OutputType      outputType    `yaml:"output_type"`
+	TimerUnit       timerUnit     `yaml:"timer_unit"`
+	Limits          seriesLimits  `yaml:"limits"`
+	TTL             time.Duration `yaml:"ttl"`
+	// NamedGroupsAsLabels overrides the default of the mapping's file.
+	NamedGroupsAsLabels *bool `yaml:"named_groups_as_labels"`
+	// legacySummary is copied from the defaults of the mapping's file.
+	legacySummary bool
+	// index is the position of the mapping in the whole configuration.
+	index int
+	// hits counts the events matched by the mapping. It is shared by the
+	// copies of the mapping handed out by getMapping.
+	hits *uint64
+	// matched, dropped and lastMatch are the mapping's children of the
+	// per-mapping telemetry.
+	matched   prometheus.Counter
+	dropped   prometheus.Counter
+	lastMatch prometheus.Gauge
 }
 
 type metricObjective struct {
-	Quantile float64 `yaml:"quantile"`
-	Error    float64 `yaml:"error"`
+	Quantile float64 `yaml:"quantile" json:"quantile"`
+	Error    float64 `yaml:"error" json:"error"`
 }
 
 var defaultQuantiles = []metricObjective{
@@ -74,11 +131,63 @@ var defaultQuantiles = []metricObjective{
 }
 
 func (m *metricMapper) initFromYAMLString(fileContents string) error {
-	var n metricMapper
-
-	if err := yaml.Unmarshal([]byte(fileContents), &n); err != nil {
+	n, err := parseMapperConfig(fileContents)
+	if err != nil {
 		return err
 	}
+	m.setConfig(n, hashMappingConfig([]mappingConfigFile{{contents: []byte(fileContents)}}))
+	return nil
+}
+
+// rawMapping captures a mapping, so that it can be decoded on its own.
+type rawMapping struct {
+	unmarshal func(interface{}) error
+}
+
+func (r *rawMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	r.unmarshal = unmarshal
+	return nil
+}
+
+// parseMapperConfig parses and validates a single YAML mapping configuration.
+// The first invalid option stops decoding, so each mapping is decoded on its
+// own and the problems of all of them are reported.
+func parseMapperConfig(fileContents string) (*metricMapper, error) {
+	var raw struct {
+		Mappings         []rawMapping `yaml:"mappings"`
+		Unmapped         interface{}  `yaml:"unmapped"`
+		Limits           interface{}  `yaml:"limits"`
+		LabelCardinality interface{}  `yaml:"label_cardinality"`
+	}
+	if err := yaml.Unmarshal([]byte(fileContents), &raw); err != nil {
+		return nil, err
+	}
+
+	var (
+		n    metricMapper
+		errs configErrors
+	)
+	// The other sections are only validated if they could be decoded, but
+	// the mappings are checked anyway.
+	err := yaml.Unmarshal([]byte(fileContents), &n)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for name, section := range map[string]interface{}{"unmapped": raw.Unmapped, "limits": raw.Limits, "label_cardinality": raw.LabelCardinality} {
+		if section != nil {
+			n.globalSections = append(n.globalSections, name)
+		}
+	}
+	sort.Strings(n.globalSections)
+	n.Mappings = make([]metricMapping, len(raw.Mappings))
+	decoded := make([]bool, len(raw.Mappings))
+	for i, r := range raw.Mappings {
+		if err := r.unmarshal(&n.Mappings[i]); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+			continue
+		}
+		decoded[i] = true
+	}
 
 	if n.Defaults.Buckets == nil || len(n.Defaults.Buckets) == 0 {
 		n.Defaults.Buckets = prometheus.DefBuckets
@@ -92,111 +201,492 @@ func (m *metricMapper) initFromYAMLString(fileContents string) error {
 		n.Defaults.MatchType = matchTypeGlob
 	}
 
+	if n.Defaults.LabelPrecedence == labelPrecedenceDefault {
+		n.Defaults.LabelPrecedence = labelPrecedenceMapping
+	}
+
+	if n.Defaults.TimerUnit == timerUnitDefault {
+		n.Defaults.TimerUnit = timerUnitMilliseconds
+	}
+
+	if err == nil {
+		errs = append(errs, n.validateSections()...)
+	}
+
 	for i := range n.Mappings {
-		currentMapping := &n.Mappings[i]
+		if !decoded[i] {
+			continue
+		}
+		if err := n.Mappings[i].init(n.Defaults); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d (%s): %v", i, n.Mappings[i].Match, err))
+		}
+	}
+	errs = append(errs, checkMappingIDs(n.Mappings)...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
 
-		// check that label is correct
-		for k := range currentMapping.Labels {
-			if !labelNameRE.MatchString(k) {
-				return fmt.Errorf("invalid label key: %s", k)
-			}
+	return &n, nil
+}
+
+// validateSections validates the global sections of a configuration.
+func (n *metricMapper) validateSections() configErrors {
+	var errs configErrors
+	if n.Defaults.TTL < 0 {
+		errs = append(errs, fmt.Errorf("defaults: ttl must not be negative"))
+	}
+	if err := n.Unmapped.init(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := n.Limits.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("limits: %v", err))
+	}
+	if err := n.LabelCardinality.init(); err != nil {
+		errs = append(errs, fmt.Errorf("label_cardinality: %v", err))
+	}
+	for i, cfg := range n.Relabel {
+		if err := cfg.init(); err != nil {
+			errs = append(errs, fmt.Errorf("relabel config %d: %v", i, err))
 		}
+	}
+	return errs
+}
 
-		if currentMapping.Name == "" {
-			return fmt.Errorf("line %d: metric mapping didn't set a metric name", i)
+// checkMappingIDs reports mapping IDs used more than once.
+func checkMappingIDs(mappings []metricMapping) configErrors {
+	var errs configErrors
+	seen := map[string]int{}
+	for i, m := range mappings {
+		if m.ID == "" {
+			continue
 		}
+		if j, ok := seen[m.ID]; ok {
+			errs = append(errs, fmt.Errorf("mapping %d (%s): id %q is already used by mapping %d", i, m.Match, m.ID, j))
+			continue
+		}
+		seen[m.ID] = i
+	}
+	return errs
+}
 
-		if !metricNameRE.MatchString(currentMapping.Name) {
-			return fmt.Errorf("metric name '%s' doesn't match regex '%s'", currentMapping.Name, metricNameRE)
+// configErrors holds all problems found in a mapping configuration, so they
+// can be fixed in one go.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// init validates a mapping, compiles its expressions and fills in unset
+// options from the defaults.
+func (m *metricMapping) init(defaults mapperConfigDefaults) error {
+	// check that label is correct
+	for k := range m.Labels {
+		if !labelNameRE.MatchString(k) {
+			return fmt.Errorf("invalid label key: %s", k)
 		}
+	}
+
+	if m.Name == "" {
+		return fmt.Errorf("metric mapping didn't set a metric name")
+	}
 
-		if currentMapping.MatchType == "" {
-			currentMapping.MatchType = n.Defaults.MatchType
+	if isTemplate(m.Name) {
+		tmpl, err := compileTemplate("name", m.Name)
+		if err != nil {
+			return fmt.Errorf("invalid metric name template '%s': %v", m.Name, err)
 		}
+		m.nameTemplate = tmpl
+	} else if !metricNameRE.MatchString(m.Name) {
+		return fmt.Errorf("metric name '%s' doesn't match regex '%s'", m.Name, metricNameRE)
+	}
+
+	for k, expr := range m.Labels {
+		if !isTemplate(expr) {
+			continue
+		}
+		tmpl, err := compileTemplate(k, expr)
+		if err != nil {
+			return fmt.Errorf("invalid template for label %s: %v", k, err)
+		}
+		if m.labelTemplates == nil {
+			m.labelTemplates = map[string]*template.Template{}
+		}
+		m.labelTemplates[k] = tmpl
+	}
 
-		if currentMapping.Action == "" {
-			currentMapping.Action = actionTypeMap
+	if m.MatchType == "" {
+		m.MatchType = defaults.MatchType
+	}
+
+	if m.Action == "" {
+		m.Action = actionTypeMap
+	}
+
+	m.hits = new(uint64)
+
+	if len(m.Match) == 0 {
+		return fmt.Errorf("metric mapping didn't set a match")
+	}
+	if m.NamedGroupsAsLabels == nil {
+		namedGroupsAsLabels := defaults.NamedGroupsAsLabels
+		m.NamedGroupsAsLabels = &namedGroupsAsLabels
+	}
+	m.regexes = make([]*regexp.Regexp, 0, len(m.Match))
+	for _, match := range m.Match {
+		regex, err := compileMatch(match, m.MatchType)
+		if err != nil {
+			return err
+		}
+		m.regexes = append(m.regexes, regex)
+		if !*m.NamedGroupsAsLabels {
+			continue
 		}
 
-		if currentMapping.MatchType == matchTypeGlob {
-			if !metricLineRE.MatchString(currentMapping.Match) {
-				return fmt.Errorf("invalid match: %s", currentMapping.Match)
+		// Named capture groups become labels, unless set explicitly. Groups
+		// whose names are no valid label names can still be referenced.
+		for _, name := range regex.SubexpNames() {
+			if name == "" || !labelNameRE.MatchString(name) {
+				continue
 			}
-			// Translate the glob-style metric match line into a proper regex that we
-			// can use to match metrics later on.
-			metricRe := strings.Replace(currentMapping.Match, ".", "\\.", -1)
-			metricRe = strings.Replace(metricRe, "*", "([^.]*)", -1)
-			if regex, err := regexp.Compile("^" + metricRe + "$"); err != nil {
-				return fmt.Errorf("invalid match %s. cannot compile regex in mapping: %v", currentMapping.Match, err)
-			} else {
-				currentMapping.regex = regex
+			if _, ok := m.Labels[name]; ok {
+				continue
 			}
-		} else {
-			if regex, err := regexp.Compile(currentMapping.Match); err != nil {
-				return fmt.Errorf("invalid regex %s in mapping: %v", currentMapping.Match, err)
-			} else {
-				currentMapping.regex = regex
+			if m.Labels == nil {
+				m.Labels = prometheus.Labels{}
 			}
+			m.Labels[name] = "${" + name + "}"
 		}
+	}
+	m.regex = m.regexes[0]
 
-		if currentMapping.TimerType == "" {
-			currentMapping.TimerType = n.Defaults.TimerType
+	if err := m.Limits.validate(); err != nil {
+		return fmt.Errorf("limits: %v", err)
+	}
+
+	if len(m.MatchLabels) > 0 {
+		m.labelRegexes = make(map[string]*regexp.Regexp, len(m.MatchLabels))
+		for k, expr := range m.MatchLabels {
+			if !labelNameRE.MatchString(k) {
+				return fmt.Errorf("invalid match_labels key: %s", k)
+			}
+			// Label matchers are fully anchored, like Prometheus label matchers.
+			regex, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return fmt.Errorf("invalid match_labels regex %s for label %s: %v", expr, k, err)
+			}
+			m.labelRegexes[k] = regex
 		}
+	}
+
+	if m.TimerType == "" {
+		m.TimerType = defaults.TimerType
+	}
+
+	if m.TimerUnit == timerUnitDefault {
+		m.TimerUnit = defaults.TimerUnit
+	}
+
+	if m.Buckets == nil || len(m.Buckets) == 0 {
+		m.Buckets = defaults.Buckets
+	}
+
+	if m.Quantiles == nil || len(m.Quantiles) == 0 {
+		m.Quantiles = defaults.Quantiles
+	}
+
+	if m.Min != nil && m.Max != nil && *m.Min > *m.Max {
+		return fmt.Errorf("min %v is greater than max %v", *m.Min, *m.Max)
+	}
+
+	if m.OutOfBounds == boundsActionDefault {
+		m.OutOfBounds = boundsActionReject
+	}
 
-		if currentMapping.Buckets == nil || len(currentMapping.Buckets) == 0 {
-			currentMapping.Buckets = n.Defaults.Buckets
+	if m.LabelPrecedence == labelPrecedenceDefault {
+		m.LabelPrecedence = defaults.LabelPrecedence
+	}
+
+	m.legacySummary = defaults.LegacySummary
+
+	if m.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	if m.TTL == 0 {
+		m.TTL = defaults.TTL
+	}
+
+	for j, cfg := range m.Relabel {
+		if err := cfg.init(); err != nil {
+			return fmt.Errorf("relabel config %d: %v", j, err)
 		}
+	}
+	return nil
+}
 
-		if currentMapping.Quantiles == nil || len(currentMapping.Quantiles) == 0 {
-			currentMapping.Quantiles = n.Defaults.Quantiles
+// compileMatch compiles a match pattern of the given type into a regex.
+func compileMatch(match string, t matchType) (*regexp.Regexp, error) {
+	if t != matchTypeGlob {
+		regex, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %s in mapping: %v", match, err)
 		}
+		return regex, nil
+	}
 
+	if !metricLineRE.MatchString(match) {
+		return nil, fmt.Errorf("invalid match: %s", match)
+	}
+	// Translate the glob-style metric match line into a proper regex that we
+	// can use to match metrics later on. "*" matches a single component,
+	// "**" one or more components.
+	components := strings.Split(match, ".")
+	for i, c := range components {
+		switch c {
+		case "**":
+			components[i] = `([^.]+(?:\.[^.]+)*)`
+		case "*":
+			components[i] = "([^.]*)"
+		default:
+			components[i] = regexp.QuoteMeta(c)
+		}
+	}
+	regex, err := regexp.Compile("^" + strings.Join(components, "\\.") + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid match %s. cannot compile regex in mapping: %v", match, err)
 	}
+	return regex, nil
+}
 
+// setConfig replaces the active configuration with the one in n, which has
+// the given hash.
+func (m *metricMapper) setConfig(n *metricMapper, hash string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	// Stop exposing telemetry for mappings that are gone.
+	current := make(map[string]bool, len(n.Mappings))
+	for i := range n.Mappings {
+		n.Mappings[i].index = i
+		current[n.Mappings[i].identity()] = true
+	}
+	for i := range m.Mappings {
+		if id := m.Mappings[i].identity(); !current[id] {
+			mappingEventsMatched.DeleteLabelValues(id)
+			mappingEventsDropped.DeleteLabelValues(id)
+			mappingLastMatch.DeleteLabelValues(id)
+			for _, action := range []boundsAction{boundsActionReject, boundsActionClamp} {
+				valuesOutOfBounds.DeleteLabelValues(id, string(action))
+			}
+		}
+	}
+	for i := range n.Mappings {
+		id := n.Mappings[i].identity()
+		n.Mappings[i].matched = mappingEventsMatched.WithLabelValues(id)
+		n.Mappings[i].dropped = mappingEventsDropped.WithLabelValues(id)
+		n.Mappings[i].lastMatch = mappingLastMatch.WithLabelValues(id)
+	}
+
 	m.Defaults = n.Defaults
 	m.Mappings = n.Mappings
+	m.Relabel = n.Relabel
+	m.Unmapped = n.Unmapped
+	m.Limits = n.Limits
+	m.LabelCardinality = n.LabelCardinality
+	m.hash = hash
 
 	mappingsCount.Set(float64(len(n.Mappings)))
+}
 
-	return nil
+// mappingConfigFiles resolves the mapping configuration path, which may be a
+// single file, a directory or a glob pattern, to a sorted list of files. In a
+// directory, all files ending in .yml or .yaml are used, except hidden ones.
+func mappingConfigFiles(path string) ([]string, error) {
+	var files []string
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mapping config pattern %s: %v", path, err)
+		}
+		for _, f := range matches {
+			if fi, err := os.Stat(f); err == nil && !fi.IsDir() {
+				files = append(files, f)
+			}
+		}
+	} else {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return []string{path}, nil
+		}
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if isMappingConfigFile(info.Name()) {
+				f := filepath.Join(path, info.Name())
+				if fi, err := os.Stat(f); err == nil && !fi.IsDir() {
+					files = append(files, f)
+				}
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no mapping config files found in %s", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// isMappingConfigFile reports whether a file in a mapping config directory
+// should be loaded.
+func isMappingConfigFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".yml" || ext == ".yaml"
+}
+
+type mappingConfigFile struct {
+	name     string
+	contents []byte
+}
+
+// readMappingConfig reads all mapping config files at path, see
+// mappingConfigFiles, and returns them along with a hash over their names and
+// contents.
+func readMappingConfig(path string) ([]mappingConfigFile, string, error) {
+	names, err := mappingConfigFiles(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	files := make([]mappingConfigFile, 0, len(names))
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, mappingConfigFile{name: name, contents: contents})
+	}
+	return files, hashMappingConfig(files), nil
+}
+
+// hashMappingConfig returns a hex encoded SHA-256 hash over the names and
+// contents of the given mapping config files.
+func hashMappingConfig(files []mappingConfigFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f.name))
+		h.Write([]byte{0})
+		h.Write(f.contents)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// configHash returns the hash of the currently loaded configuration.
+func (m *metricMapper) configHash() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.hash
 }
 
-func (m *metricMapper) initFromFile(fileName string) error {
-	mappingStr, err := ioutil.ReadFile(fileName)
+// initFromFile loads the mapping configuration from a file, a directory or a
+// glob pattern. Multiple files are loaded in lexical order. The defaults of
+// each file apply to its own mappings only, while the defaults and the
+// unmapped policy of the first file also apply to metrics that don't match any
+// mapping.
+func (m *metricMapper) initFromFile(path string) error {
+	files, hash, err := readMappingConfig(path)
 	if err != nil {
 		return err
 	}
-	return m.initFromYAMLString(string(mappingStr))
+
+	var (
+		merged *metricMapper
+		errs   configErrors
+	)
+	for _, f := range files {
+		n, err := parseMapperConfig(string(f.contents))
+		if fileErrs, ok := err.(configErrors); ok {
+			for _, err := range fileErrs {
+				errs = append(errs, fmt.Errorf("%s: %v", f.name, err))
+			}
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", f.name, err))
+			continue
+		}
+		if merged == nil {
+			merged = n
+			continue
+		}
+		for _, section := range n.globalSections {
+			errs = append(errs, fmt.Errorf("%s: %s can only be set in the first file", f.name, section))
+		}
+		merged.Mappings = append(merged.Mappings, n.Mappings...)
+		merged.Relabel = append(merged.Relabel, n.Relabel...)
+	}
+	if merged != nil && len(files) > 1 {
+		errs = append(errs, checkMappingIDs(merged.Mappings)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	m.setConfig(merged, hash)
+	return nil
 }
 
-func (m *metricMapper) getMapping(statsdMetric string, statsdMetricType metricType) (*metricMapping, prometheus.Labels, bool) {
+func (m *metricMapper) getMapping(statsdMetric string, statsdMetricType metricType, statsdLabels map[string]string) (*metricMapping, prometheus.Labels, bool) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	for _, mapping := range m.Mappings {
-		matches := mapping.regex.FindStringSubmatchIndex(statsdMetric)
+		var matches []int
+		for _, regex := range mapping.regexes {
+			if matches = regex.FindStringSubmatchIndex(statsdMetric); matches != nil {
+				mapping.regex = regex
+				break
+			}
+		}
 		if len(matches) == 0 {
 			continue
 		}
 
-		mapping.Name = string(mapping.regex.ExpandString(
-			[]byte{},
-			mapping.Name,
-			statsdMetric,
-			matches,
-		))
+		if !mapping.MatchMetricType.contains(statsdMetricType) {
+			continue
+		}
 
-		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
+		if !mapping.matchesLabels(statsdLabels) {
 			continue
 		}
 
+		name, err := mapping.expand(mapping.Name, mapping.nameTemplate, statsdMetric, matches, statsdLabels)
+		if err != nil || name == "" {
+			log.Debugf("Error expanding name of mapping %q for metric %q: %v", mapping.Match, statsdMetric, err)
+			continue
+		}
+		mapping.Name = name
+
 		labels := prometheus.Labels{}
 		for label, valueExpr := range mapping.Labels {
-			value := mapping.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
-			labels[label] = string(value)
+			value, err := mapping.expand(valueExpr, mapping.labelTemplates[label], statsdMetric, matches, statsdLabels)
+			if err != nil {
+				log.Debugf("Error expanding label %q of mapping %q for metric %q: %v", label, mapping.Match, statsdMetric, err)
+			}
+			labels[label] = value
 		}
 
 		return &mapping, labels, true
@@ -204,3 +694,131 @@ func (m *metricMapper) getMapping(statsdMetric string, statsdMetricType metricTy
 
 	return nil, nil, false
 }
+
+// defaultMapping returns the mapping that applies to metrics that match no
+// mapping, which has the settings of the first file's defaults.
+func (m *metricMapper) defaultMapping() *metricMapping {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return &metricMapping{
+		TimerType:       m.Defaults.TimerType,
+		TimerUnit:       m.Defaults.TimerUnit,
+		Buckets:         m.Defaults.Buckets,
+		Quantiles:       m.Defaults.Quantiles,
+		LabelPrecedence: m.Defaults.LabelPrecedence,
+		TTL:             m.Defaults.TTL,
+		legacySummary:   m.Defaults.LegacySummary,
+	}
+}
+
+// globalRelabelConfigs returns the relabel configs that apply to all metrics.
+func (m *metricMapper) globalRelabelConfigs() []*relabelConfig {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.Relabel
+}
+
+// expand renders a name or label expression for a matched metric. If the
+// expression is a template, tmpl is executed; otherwise $n references are
+// substituted with the matched groups.
+func (m *metricMapping) expand(expr string, tmpl *template.Template, statsdMetric string, matches []int, tags map[string]string) (string, error) {
+	if tmpl == nil {
+		return string(m.regex.ExpandString([]byte{}, expr, statsdMetric, matches)), nil
+	}
+
+	submatches := make([]string, len(matches)/2)
+	groups := map[string]string{}
+	for i, name := range m.regex.SubexpNames() {
+		if i >= len(submatches) || matches[2*i] < 0 {
+			continue
+		}
+		submatches[i] = statsdMetric[matches[2*i]:matches[2*i+1]]
+		if name != "" {
+			groups[name] = submatches[i]
+		}
+	}
+	return executeTemplate(tmpl, statsdMetric, submatches, groups, tags)
+}
+
+// matchesLabels reports whether the given event labels satisfy all of the
+// mapping's match_labels conditions. A missing label is treated as having an
+// empty value.
+func (m *metricMapping) matchesLabels(labels map[string]string) bool {
+	for k, regex := range m.labelRegexes {
+		if !regex.MatchString(labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// identity returns the ID of the mapping, or its index and match if it has
+// none.
+func (m *metricMapping) identity() string {
+	if m.ID != "" {
+		return m.ID
+	}
+	return fmt.Sprintf("%d:%s", m.index, m.Match)
+}
+
+// recordHit counts an event matched by the mapping.
+func (m *metricMapping) recordHit() {
+	if m.hits != nil {
+		atomic.AddUint64(m.hits, 1)
+	}
+	if m.matched != nil {
+		m.matched.Inc()
+		m.lastMatch.Set(float64(time.Now().UnixNano()) / 1e9)
+	}
+}
+
+// recordDrop counts an event dropped by the mapping.
+func (m *metricMapping) recordDrop() {
+	if m.dropped != nil {
+		m.dropped.Inc()
+	}
+}
+
+// hitCount returns the number of events matched by the mapping since the
+// configuration was loaded.
+func (m *metricMapping) hitCount() uint64 {
+	if m.hits == nil {
+		return 0
+	}
+	return atomic.LoadUint64(m.hits)
+}
+
+// unmappedPolicy returns the policy for metrics that match no mapping.
+func (m *metricMapper) unmappedPolicy() unmappedPolicy {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.Unmapped
+}
+
+// seriesLimits returns the global series limits.
+func (m *metricMapper) seriesLimits() seriesLimits {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.Limits
+}
+
+// labelCardinality returns the configuration of the high-cardinality label
+// detection.
+func (m *metricMapper) labelCardinality() labelCardinality {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.LabelCardinality
+}
+
+// currentMappings returns the mappings of the active configuration.
+func (m *metricMapper) currentMappings() []metricMapping {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.Mappings
+}
@@ -14,7 +14,14 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type mappings map[string]struct {
@@ -175,6 +182,68 @@ mappings:
 				},
 			},
 		},
+		// Config with "**" matching one or more components.
+		{
+			config: `---
+mappings:
+- match: app.**.requests
+  name: "app_requests_total"
+  labels:
+    path: "$1"
+- match: app.*.**
+  name: "app_$1"
+  labels:
+    rest: "$2"
+`,
+			mappings: mappings{
+				"app.api.requests": {
+					name: "app_requests_total",
+					labels: map[string]string{
+						"path": "api",
+					},
+				},
+				"app.api.users.get.requests": {
+					name: "app_requests_total",
+					labels: map[string]string{
+						"path": "api.users.get",
+					},
+				},
+				"app.web.errors": {
+					name: "app_web",
+					labels: map[string]string{
+						"rest": "errors",
+					},
+				},
+				"app.web.errors.total": {
+					name: "app_web",
+					labels: map[string]string{
+						"rest": "errors.total",
+					},
+				},
+				"app.web": {
+					notPresent: true,
+				},
+				// "**" doesn't match zero or empty components.
+				"app.requests": {
+					notPresent: true,
+				},
+				"app.web.": {
+					notPresent: true,
+				},
+				"app.api..users.requests": {
+					notPresent: true,
+				},
+			},
+		},
+		// Config with a partial "**" component.
+		{
+			config: `---
+mappings:
+- match: test.***
+  name: "foo"
+  `,
+			configBad: true,
+		},
 		// Config with bad metric line.
 		{
 			config: `---
@@ -485,7 +554,7 @@ mappings:
 
 		var dummyMetricType metricType = ""
 		for metric, mapping := range scenario.mappings {
-			m, labels, present := mapper.getMapping(metric, dummyMetricType)
+			m, labels, present := mapper.getMapping(metric, dummyMetricType, nil)
 			if present && mapping.name != "" && m.Name != mapping.name {
 				t.Fatalf("%d.%q: Expected name %v, got %v", i, metric, m.Name, mapping.name)
 			}
@@ -587,3 +656,530 @@ mappings:
 		}
 	}
 }
+
+func TestMatchLabels(t *testing.T) {
+	config := `---
+mappings:
+- match: request.duration
+  match_labels:
+    env: dev
+  action: drop
+  name: "dropped"
+- match: request.duration
+  match_labels:
+    env: prod
+    service: "api-.*"
+  name: "api_request_duration"
+- match: request.duration
+  name: "request_duration"
+`
+	scenarios := []struct {
+		labels   map[string]string
+		name     string
+		action   actionType
+		notFound bool
+	}{
+		{
+			labels: map[string]string{"env": "dev", "service": "api-users"},
+			name:   "dropped",
+			action: actionTypeDrop,
+		},
+		{
+			labels: map[string]string{"env": "prod", "service": "api-users"},
+			name:   "api_request_duration",
+			action: actionTypeMap,
+		},
+		{
+			// Label matchers are anchored.
+			labels: map[string]string{"env": "preprod", "service": "web-api-users"},
+			name:   "request_duration",
+			action: actionTypeMap,
+		},
+		{
+			labels: nil,
+			name:   "request_duration",
+			action: actionTypeMap,
+		},
+	}
+
+	mapper := metricMapper{}
+	if err := mapper.initFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	for i, scenario := range scenarios {
+		m, _, present := mapper.getMapping("request.duration", metricTypeTimer, scenario.labels)
+		if !present {
+			t.Fatalf("%d: Expected mapping to be present", i)
+		}
+		if m.Name != scenario.name {
+			t.Fatalf("%d: Expected name %v, got %v", i, scenario.name, m.Name)
+		}
+		if m.Action != scenario.action {
+			t.Fatalf("%d: Expected action %v, got %v", i, scenario.action, m.Action)
+		}
+	}
+
+	badConfigs := []string{
+		`---
+mappings:
+- match: test.*
+  match_labels:
+    "bad-label": foo
+  name: "foo"
+`,
+		`---
+mappings:
+- match: test.*
+  match_labels:
+    env: "(foo"
+  name: "foo"
+`,
+	}
+	for i, config := range badConfigs {
+		if err := mapper.initFromYAMLString(config); err == nil {
+			t.Fatalf("%d: Expected bad config, but loaded ok: %s", i, config)
+		}
+	}
+}
+
+func TestNamedCaptureGroups(t *testing.T) {
+	config := `---
+defaults:
+  named_groups_as_labels: true
+mappings:
+- match: servers\.(?P<host>[^.]+)\.(?P<region>[^.]+)\.(\w+)
+  match_type: regex
+  name: "server_${3}_total"
+- match: hosts\.(?P<host>[^.]+)\.(?P<disk>[^.]+)\.usage
+  match_type: regex
+  name: "host_${disk}_usage"
+  labels:
+    disk: "{{ upper ${disk} }}"
+    instance: "${host}:9100"
+- match: jobs\.(?P<job>[^.]+)\.(?P<x>[^.]+)\.runs
+  match_type: regex
+  name: "job_${x}_runs_total"
+- match: queues\.(?P<queue>[^.]+)\.length
+  match_type: regex
+  name: "queue_${queue}_length"
+  named_groups_as_labels: false
+`
+	scenarios := []struct {
+		metric string
+		name   string
+		labels prometheus.Labels
+	}{
+		{
+			metric: "servers.web01.eu.requests",
+			name:   "server_requests_total",
+			labels: prometheus.Labels{"host": "web01", "region": "eu"},
+		},
+		{
+			// Explicit labels take precedence over named groups.
+			metric: "hosts.db01.sda.usage",
+			name:   "host_sda_usage",
+			labels: prometheus.Labels{"host": "db01", "disk": "SDA", "instance": "db01:9100"},
+		},
+		{
+			// Groups whose names are no valid label names are skipped.
+			metric: "jobs.backup.daily.runs",
+			name:   "job_daily_runs_total",
+			labels: prometheus.Labels{"job": "backup"},
+		},
+		{
+			metric: "queues.mail.length",
+			name:   "queue_mail_length",
+			labels: prometheus.Labels{},
+		},
+	}
+
+	mapper := metricMapper{}
+	if err := mapper.initFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	for i, scenario := range scenarios {
+		m, labels, present := mapper.getMapping(scenario.metric, metricTypeCounter, nil)
+		if !present {
+			t.Fatalf("%d: Expected mapping to be present", i)
+		}
+		if m.Name != scenario.name {
+			t.Fatalf("%d: Expected name %v, got %v", i, scenario.name, m.Name)
+		}
+		if !reflect.DeepEqual(labels, scenario.labels) {
+			t.Fatalf("%d: Expected labels %v, got %v", i, scenario.labels, labels)
+		}
+	}
+
+	// Without the option, named groups are only available as references.
+	if err := mapper.initFromYAMLString(`---
+mappings:
+- match: test\.(?P<host>\w+)
+  match_type: regex
+  name: "test_${host}"
+`); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	m, labels, present := mapper.getMapping("test.web01", metricTypeCounter, nil)
+	if !present || m.Name != "test_web01" || len(labels) != 0 {
+		t.Fatalf("Expected test_web01 without labels, got %v %v", m, labels)
+	}
+}
+
+func TestMatchLists(t *testing.T) {
+	config := `---
+mappings:
+- match:
+  - legacy.*.requests
+  - app.*.requests.total
+  match_metric_type: [ counter, gauge ]
+  name: "requests_total"
+  labels:
+    service: "$1"
+- match:
+  - legacy\.(\w+)\.errors
+  - app\.(?P<service>\w+)\.errors
+  match_type: regex
+  name: "errors_total"
+  labels:
+    service: "$1"
+- match: "*.**"
+  match_metric_type: timer
+  name: "timers"
+`
+	scenarios := []struct {
+		metric     string
+		metricType metricType
+		name       string
+		labels     prometheus.Labels
+		notPresent bool
+	}{
+		{
+			metric:     "legacy.api.requests",
+			metricType: metricTypeCounter,
+			name:       "requests_total",
+			labels:     prometheus.Labels{"service": "api"},
+		},
+		{
+			metric:     "app.api.requests.total",
+			metricType: metricTypeGauge,
+			name:       "requests_total",
+			labels:     prometheus.Labels{"service": "api"},
+		},
+		{
+			metric:     "app.api.requests.total",
+			metricType: metricTypeTimer,
+			name:       "timers",
+			labels:     prometheus.Labels{},
+		},
+		{
+			metric:     "legacy.api.errors",
+			metricType: metricTypeCounter,
+			name:       "errors_total",
+			labels:     prometheus.Labels{"service": "api"},
+		},
+		{
+			// References expand against the pattern that matched.
+			metric:     "app.web.errors",
+			metricType: metricTypeCounter,
+			name:       "errors_total",
+			labels:     prometheus.Labels{"service": "web"},
+		},
+		{
+			metric:     "other.requests",
+			metricType: metricTypeCounter,
+			notPresent: true,
+		},
+	}
+
+	mapper := metricMapper{}
+	if err := mapper.initFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	for i, scenario := range scenarios {
+		m, labels, present := mapper.getMapping(scenario.metric, scenario.metricType, nil)
+		if present == scenario.notPresent {
+			t.Fatalf("%d: Expected present %t, got %t", i, !scenario.notPresent, present)
+		}
+		if !present {
+			continue
+		}
+		if m.Name != scenario.name {
+			t.Fatalf("%d: Expected name %v, got %v", i, scenario.name, m.Name)
+		}
+		if !reflect.DeepEqual(labels, scenario.labels) {
+			t.Fatalf("%d: Expected labels %v, got %v", i, scenario.labels, labels)
+		}
+	}
+
+	badConfigs := []string{
+		`---
+mappings:
+- match: [ test.*, bad--metric-line.* ]
+  name: "foo"
+`,
+		`---
+mappings:
+- match: test.*
+  match_metric_type: [ counter, set ]
+  name: "foo"
+`,
+		`---
+mappings:
+- match: []
+  name: "foo"
+`,
+	}
+	for i, config := range badConfigs {
+		if err := mapper.initFromYAMLString(config); err == nil {
+			t.Fatalf("%d: Expected bad config, but loaded ok: %s", i, config)
+		}
+	}
+}
+
+func TestValueTransform(t *testing.T) {
+	config := `---
+mappings:
+- match: timer.us.*
+  name: "timer_us"
+  scale: 0.001
+- match: temperature.*
+  name: "temperature"
+  offset: -273.15
+  min: -100
+  max: 100
+  out_of_bounds: clamp
+- match: bounded.*
+  name: "bounded"
+  max: 1000000000
+`
+	scenarios := []struct {
+		metric   string
+		in       float64
+		relative bool
+		out      float64
+		rejected bool
+	}{
+		{metric: "timer.us.a", in: 1500, out: 1.5},
+		{metric: "temperature.a", in: 300, out: 26.85},
+		{metric: "temperature.a", in: 10, out: -100},
+		{metric: "temperature.a", in: 1000, out: 100},
+		{metric: "temperature.a", in: 5, relative: true, out: 5},
+		{metric: "temperature.a", in: -500, relative: true, out: -500},
+		{metric: "bounded.a", in: 1e18, relative: true, out: 1e18},
+		{metric: "bounded.a", in: 1e18, rejected: true},
+		{metric: "bounded.a", in: 42, out: 42},
+		{metric: "unmapped", in: 1e18, out: 1e18},
+	}
+
+	mapper := metricMapper{}
+	if err := mapper.initFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	for i, scenario := range scenarios {
+		m, _, present := mapper.getMapping(scenario.metric, metricTypeGauge, nil)
+		if !present {
+			m = &metricMapping{}
+		}
+		out, ok := m.transformValue(scenario.in, scenario.relative)
+		if ok == scenario.rejected {
+			t.Fatalf("%d: Expected rejected to be %v", i, scenario.rejected)
+		}
+		if ok && (out-scenario.out > 1e-9 || scenario.out-out > 1e-9) {
+			t.Fatalf("%d: Expected value %v, got %v", i, scenario.out, out)
+		}
+	}
+
+	// The out of bounds telemetry of removed mappings goes away on reload.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(valuesOutOfBounds)
+	outOfBounds := func() []string {
+		var series []string
+		for _, s := range gatherSeries(t, registry) {
+			if strings.Contains(s, "temperature") || strings.Contains(s, "bounded") {
+				series = append(series, s)
+			}
+		}
+		return series
+	}
+	if got := outOfBounds(); len(got) != 2 {
+		t.Fatalf("Expected out of bounds telemetry for 2 mappings, got %v", got)
+	}
+	if err := mapper.initFromYAMLString("mappings:\n- match: timer.us.*\n  name: timer_us\n"); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	if got := outOfBounds(); len(got) != 0 {
+		t.Fatalf("Expected no out of bounds telemetry for removed mappings, got %v", got)
+	}
+
+	badConfigs := []string{
+		`---
+mappings:
+- match: test.*
+  name: "foo"
+  min: 10
+  max: 1
+`,
+		`---
+mappings:
+- match: test.*
+  name: "foo"
+  max: 1
+  out_of_bounds: ignore
+`,
+	}
+	for i, config := range badConfigs {
+		if err := mapper.initFromYAMLString(config); err == nil {
+			t.Fatalf("%d: Expected bad config, but loaded ok: %s", i, config)
+		}
+	}
+}
+
+func TestMultipleConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"10-team-a.yml": `
+defaults:
+  timer_type: histogram
+mappings:
+- match: alpha.*
+  name: "team_a"
+- match: shared.*
+  name: "shared_a"
+`,
+		"20-team-b.yaml": `
+defaults:
+  legacy_summary_units: true
+mappings:
+- match: beta.*
+  name: "team_b"
+- match: shared.*
+  name: "shared_b"
+`,
+		".hidden.yml": `mappings: [`,
+		"README.md":   `not a mapping file`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{dir, filepath.Join(dir, "*-team-*")} {
+		mapper := metricMapper{}
+		if err := mapper.initFromFile(path); err != nil {
+			t.Fatalf("%s: Config load error: %s", path, err)
+		}
+		if len(mapper.Mappings) != 4 {
+			t.Fatalf("%s: Expected 4 mappings, got %d", path, len(mapper.Mappings))
+		}
+
+		// Files are merged in lexical order, so the first file wins.
+		m, _, _ := mapper.getMapping("shared.x", metricTypeTimer, nil)
+		if m.Name != "shared_a" {
+			t.Fatalf("%s: Expected name shared_a, got %s", path, m.Name)
+		}
+
+		// File-level defaults only apply to the mappings of that file.
+		m, _, _ = mapper.getMapping("alpha.x", metricTypeTimer, nil)
+		if m.TimerType != timerTypeHistogram {
+			t.Fatalf("%s: Expected timer type histogram, got %s", path, m.TimerType)
+		}
+		m, _, _ = mapper.getMapping("beta.x", metricTypeTimer, nil)
+		if m.TimerType == timerTypeHistogram {
+			t.Fatalf("%s: Defaults of another file were applied", path)
+		}
+		ex := NewExporter(&mapper)
+		if got := ex.timerValue(500, m, outputTypeSummary); got != 500 {
+			t.Fatalf("%s: Expected legacy summary value 500, got %v", path, got)
+		}
+		m, _, _ = mapper.getMapping("alpha.x", metricTypeTimer, nil)
+		if got := ex.timerValue(500, m, outputTypeSummary); got != 0.5 {
+			t.Fatalf("%s: Expected summary value 0.5, got %v", path, got)
+		}
+	}
+
+	bad := filepath.Join(dir, "30-broken.yml")
+	if err := ioutil.WriteFile(bad, []byte("mappings:\n- match: gamma.*\n  name: \"0bad\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapper := metricMapper{}
+	err = mapper.initFromFile(dir)
+	if err == nil {
+		t.Fatalf("Expected bad config, but loaded ok")
+	}
+	if !strings.Contains(err.Error(), bad) || !strings.Contains(err.Error(), "mapping 0") {
+		t.Fatalf("Expected error to name the file and mapping, got: %s", err)
+	}
+
+	// Invalid options are reported with the file and mapping as well.
+	if err := ioutil.WriteFile(bad, []byte("mappings:\n- match: gamma.*\n  name: \"gamma\"\n  timer_type: bogus\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = mapper.initFromFile(dir)
+	if err == nil || !strings.Contains(err.Error(), bad+": mapping 0: invalid timer type") {
+		t.Fatalf("Expected error to name the file and mapping, got: %v", err)
+	}
+
+	// Global sections are only taken from the first file.
+	if err := ioutil.WriteFile(bad, []byte("limits:\n  max_series: 10\nunmapped:\n  action: drop\nmappings: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = mapper.initFromFile(dir)
+	if err == nil || !strings.Contains(err.Error(), bad+": limits can only be set in the first file") || !strings.Contains(err.Error(), bad+": unmapped can only be set in the first file") {
+		t.Fatalf("Expected errors for global sections in a later file, got: %v", err)
+	}
+
+	if err := mapper.initFromFile(filepath.Join(dir, "*.nothing")); err == nil {
+		t.Fatalf("Expected error for pattern without matches")
+	}
+}
+
+func TestMappingConfigHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func() string {
+		_, h, err := readMappingConfig(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write("a.yml", "mappings: []\n")
+	mapper := metricMapper{}
+	if err := mapper.initFromFile(dir); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	initial := mapper.configHash()
+	if initial == "" || initial != hash() {
+		t.Fatalf("Expected loaded hash %q to match the files, got %q", hash(), initial)
+	}
+
+	write("a.yml", "mappings: []\n")
+	if hash() != initial {
+		t.Fatalf("Hash changed although the contents did not")
+	}
+
+	write("b.yml", "mappings: []\n")
+	if hash() == initial {
+		t.Fatalf("Hash did not change when a file was added")
+	}
+}
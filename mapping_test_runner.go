@@ -0,0 +1,180 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// mappingTestFile is a file of unit tests for a mapping configuration.
+type mappingTestFile struct {
+	// MappingConfig is the mapping configuration file, directory or glob
+	// pattern under test, relative to the test file.
+	MappingConfig string            `yaml:"mapping_config"`
+	Tests         []mappingTestCase `yaml:"tests"`
+}
+
+// mappingTestCase lists StatsD lines and the series they are expected to
+// produce, in the Prometheus text format.
+type mappingTestCase struct {
+	Name     string `yaml:"name"`
+	Lines    string `yaml:"lines"`
+	Expected string `yaml:"expected"`
+}
+
+// runMappingTests runs the mapping unit tests in the given files and writes
+// the results to out. It returns false if any test failed.
+func runMappingTests(paths []string, out io.Writer) bool {
+	success := true
+	for _, path := range paths {
+		fmt.Fprintln(out, "Testing", path)
+		if !runMappingTestFile(path, out) {
+			success = false
+		}
+	}
+	return success
+}
+
+// runMappingTestFile runs the tests in the file at path and writes the
+// results to out. It returns false if any test failed.
+func runMappingTestFile(path string, out io.Writer) bool {
+	fail := func(format string, args ...interface{}) bool {
+		fmt.Fprintf(out, "  FAILED: "+format+"\n", args...)
+		return false
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fail("%v", err)
+	}
+	var f mappingTestFile
+	if err := yaml.UnmarshalStrict(contents, &f); err != nil {
+		return fail("%s: %v", path, err)
+	}
+	if f.MappingConfig == "" {
+		return fail("%s: no mapping_config set", path)
+	}
+
+	config := f.MappingConfig
+	if !filepath.IsAbs(config) {
+		config = filepath.Join(filepath.Dir(path), config)
+	}
+	mapper := &metricMapper{}
+	if err := mapper.initFromFile(config); err != nil {
+		return fail("error loading mapping config: %v", err)
+	}
+
+	success := true
+	for i, tc := range f.Tests {
+		name := tc.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i)
+		}
+		diff, err := runMappingTest(mapper, tc)
+		switch {
+		case err != nil:
+			success = fail("%s: %v", name, err)
+		case len(diff) > 0:
+			success = fail("%s: unexpected metrics (-expected +got):\n    %s", name, strings.Join(diff, "\n    "))
+		default:
+			fmt.Fprintf(out, "  PASSED: %s\n", name)
+		}
+	}
+	return success
+}
+
+// runMappingTest feeds the lines of a test case to a new exporter and
+// returns the differences between the expected and the resulting samples.
+func runMappingTest(mapper *metricMapper, tc mappingTestCase) ([]string, error) {
+	exporter := NewExporter(mapper)
+	for _, line := range strings.Split(tc.Lines, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		for _, event := range lineToEvents(line) {
+			exporter.handleEvent(event)
+		}
+	}
+
+	mfs, err := exporter.registry.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("error gathering metrics: %v", err)
+	}
+	got, err := sampleLines(mfs)
+	if err != nil {
+		return nil, err
+	}
+
+	var parser expfmt.TextParser
+	expectedFamilies, err := parser.TextToMetricFamilies(strings.NewReader(tc.Expected))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing expected metrics: %v", err)
+	}
+	mfs = mfs[:0]
+	for _, mf := range expectedFamilies {
+		mfs = append(mfs, mf)
+	}
+	expected, err := sampleLines(mfs)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffLines(expected, got), nil
+}
+
+// sampleLines returns the samples of the given metric families as sorted
+// lines of the form `name{labels} value`, so that they can be compared
+// regardless of the order of series and labels.
+func sampleLines(mfs []*dto.MetricFamily) ([]string, error) {
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{}, mfs...)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		lines = append(lines, fmt.Sprintf("%s %s", s.Metric, s.Value))
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// diffLines compares two sorted slices of lines. Lines only in expected are
+// prefixed with "-", lines only in got with "+".
+func diffLines(expected, got []string) []string {
+	var diff []string
+	i, j := 0, 0
+	for i < len(expected) || j < len(got) {
+		switch {
+		case j >= len(got) || (i < len(expected) && expected[i] < got[j]):
+			diff = append(diff, "- "+expected[i])
+			i++
+		case i >= len(expected) || got[j] < expected[i]:
+			diff = append(diff, "+ "+got[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return diff
+}
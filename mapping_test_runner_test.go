@@ -0,0 +1,124 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMappingTests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_mapping_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mapping := `---
+mappings:
+- match: test.*.timer
+  timer_type: histogram
+  buckets: [ 0.1, 1 ]
+  name: "test_timer_seconds"
+  labels:
+    job: "$1"
+- match: test.dropped
+  name: "dropped"
+  action: drop
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "mapping.yml"), []byte(mapping), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		tests   string
+		success bool
+		output  []string
+	}{
+		{
+			tests: `---
+mapping_config: mapping.yml
+tests:
+- name: timers
+  lines: |
+    test.web.timer:5|ms
+    test.web.timer:500|ms
+    test.dropped:1|c
+  expected: |
+    # TYPE test_timer_seconds histogram
+    test_timer_seconds_bucket{le="0.1",job="web"} 1
+    test_timer_seconds_bucket{job="web",le="1"} 2
+    test_timer_seconds_bucket{job="web",le="+Inf"} 2
+    test_timer_seconds_sum{job="web"} 0.505
+    test_timer_seconds_count{job="web"} 2
+`,
+			success: true,
+			output:  []string{"PASSED: timers"},
+		},
+		{
+			tests: `---
+mapping_config: mapping.yml
+tests:
+- name: counters
+  lines: |
+    test.counter:2|c
+  expected: |
+    test_counter 1
+    test_other 1
+`,
+			output: []string{
+				"FAILED: counters: unexpected metrics (-expected +got):\n" +
+					"    - test_counter 1\n" +
+					"    + test_counter 2\n" +
+					"    - test_other 1\n",
+			},
+		},
+		{
+			tests: `---
+mapping_config: missing.yml
+`,
+			output: []string{"FAILED: error loading mapping config"},
+		},
+		{
+			tests: `---
+mapping_config: mapping.yml
+tests:
+- name: typo
+  line: "test.counter:2|c"
+`,
+			output: []string{"FAILED: ", "field line not found"},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		path := filepath.Join(dir, "tests.yml")
+		if err := ioutil.WriteFile(path, []byte(scenario.tests), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if success := runMappingTests([]string{path}, &out); success != scenario.success {
+			t.Fatalf("%d. Expected success %t, got %t: %s", i, scenario.success, success, out.String())
+		}
+		for _, o := range scenario.output {
+			if !strings.Contains(out.String(), o) {
+				t.Fatalf("%d. Expected output to contain %q, got %q", i, o, out.String())
+			}
+		}
+	}
+}
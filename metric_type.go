@@ -13,7 +13,10 @@
 
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 type metricType string
 
@@ -41,3 +44,47 @@ func (m *metricType) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 	return nil
 }
+
+// metricTypeList is a list of metric types that can also be written as a
+// single type.
+type metricTypeList []metricType
+
+func (l *metricTypeList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		var t metricType
+		if err := unmarshal(&t); err != nil {
+			return err
+		}
+		*l = metricTypeList{t}
+		return nil
+	}
+
+	var list []metricType
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func (l metricTypeList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]metricType(l))
+}
+
+// contains reports whether t is in the list. An empty list contains all
+// metric types.
+func (l metricTypeList) contains(t metricType) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, lt := range l {
+		if lt == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// outputType is the Prometheus metric type a StatsD event is recorded as.
+type outputType string
+
+const (
+	outputTypeCounter   outputType = "counter"
+	outputTypeGauge     outputType = "gauge"
+	outputTypeSummary   outputType = "summary"
+	outputTypeHistogram outputType = "histogram"
+	outputTypeDefault   outputType = ""
+)
+
+func (t *outputType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch outputType(v) {
+	case outputTypeCounter:
+		*t = outputTypeCounter
+	case outputTypeGauge:
+		*t = outputTypeGauge
+	case outputTypeSummary:
+		*t = outputTypeSummary
+	case outputTypeHistogram:
+		*t = outputTypeHistogram
+	case outputTypeDefault:
+		*t = outputTypeDefault
+	default:
+		return fmt.Errorf("invalid output type '%s'", v)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// exporterRegistry holds the series created from StatsD events. A registry
+// remembers the help text and label names of every metric name it has seen,
+// even after unregistering, so the registry is replaced whenever a config
+// reload changes existing series.
+type exporterRegistry struct {
+	mtx      sync.RWMutex
+	registry *prometheus.Registry
+}
+
+func newExporterRegistry() *exporterRegistry {
+	return &exporterRegistry{registry: prometheus.NewRegistry()}
+}
+
+// reservedNames holds the names of the metrics in the default registry, which
+// series are served along with. Besides the exporter's own metrics, these are
+// the metrics of the Go runtime, the process and the instrumented handlers.
+var reservedNames = func() map[string]bool {
+	names := map[string]bool{
+		"http_requests_total":                true,
+		"http_request_duration_microseconds": true,
+		"http_request_size_bytes":            true,
+		"http_response_size_bytes":           true,
+	}
+	collectors := append([]prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(os.Getpid(), ""),
+	}, ownMetrics...)
+	for _, c := range collectors {
+		for _, name := range metricNames(c) {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+// metricNames returns the names of the metrics a collector describes. The
+// client library only exposes them in the string form of the descriptors.
+func metricNames(c prometheus.Collector) []string {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	var names []string
+	for desc := range descs {
+		var name string
+		if _, err := fmt.Sscanf(desc.String(), "Desc{fqName: %q", &name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Register registers a series, unless it takes the name of one of the reserved
+// metrics, which would make gathering them fail.
+func (r *exporterRegistry) Register(c prometheus.Collector) error {
+	for _, name := range metricNames(c) {
+		if reservedNames[name] {
+			return fmt.Errorf("%s is the name of one of the exporter's own metrics", name)
+		}
+	}
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.registry.Register(c)
+}
+
+func (r *exporterRegistry) MustRegister(cs ...prometheus.Collector) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	r.registry.MustRegister(cs...)
+}
+
+func (r *exporterRegistry) Unregister(c prometheus.Collector) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.registry.Unregister(c)
+}
+
+func (r *exporterRegistry) Gather() ([]*dto.MetricFamily, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.registry.Gather()
+}
+
+// reset replaces the registry with a new one holding only the given
+// collectors. The errors of collectors that fail to register are returned.
+func (r *exporterRegistry) reset(cs []prometheus.Collector) map[prometheus.Collector]error {
+	registry := prometheus.NewRegistry()
+	failed := map[prometheus.Collector]error{}
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			failed[c] = err
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.registry = registry
+	return failed
+}
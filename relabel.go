@@ -0,0 +1,180 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type relabelAction string
+
+const (
+	relabelActionReplace   relabelAction = "replace"
+	relabelActionLabelDrop relabelAction = "labeldrop"
+	relabelActionLabelKeep relabelAction = "labelkeep"
+	relabelActionHashMod   relabelAction = "hashmod"
+	relabelActionLowercase relabelAction = "lowercase"
+	relabelActionDefault   relabelAction = ""
+)
+
+func (a *relabelAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch relabelAction(strings.ToLower(v)) {
+	case relabelActionReplace, relabelActionDefault:
+		*a = relabelActionReplace
+	case relabelActionLabelDrop:
+		*a = relabelActionLabelDrop
+	case relabelActionLabelKeep:
+		*a = relabelActionLabelKeep
+	case relabelActionHashMod:
+		*a = relabelActionHashMod
+	case relabelActionLowercase:
+		*a = relabelActionLowercase
+	default:
+		return fmt.Errorf("invalid relabel action %q", v)
+	}
+	return nil
+}
+
+// relabelConfig describes a single relabeling step applied to the label set
+// of a metric after mapping. The semantics follow Prometheus' relabel_config.
+type relabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels"`
+	Separator    *string       `yaml:"separator"`
+	Regex        *string       `yaml:"regex"`
+	Modulus      uint64        `yaml:"modulus"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  *string       `yaml:"replacement"`
+	Action       relabelAction `yaml:"action"`
+	regex        *regexp.Regexp
+	separator    string
+	replacement  string
+}
+
+// init validates the relabel config and fills in the defaults.
+func (c *relabelConfig) init() error {
+	if c.Action == relabelActionDefault {
+		c.Action = relabelActionReplace
+	}
+
+	c.separator = ";"
+	if c.Separator != nil {
+		c.separator = *c.Separator
+	}
+	c.replacement = "$1"
+	if c.Replacement != nil {
+		c.replacement = *c.Replacement
+	}
+
+	expr := "(.*)"
+	if c.Regex != nil {
+		expr = *c.Regex
+	}
+	regex, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex %s: %v", expr, err)
+	}
+	c.regex = regex
+
+	for _, l := range c.SourceLabels {
+		if !labelNameRE.MatchString(l) {
+			return fmt.Errorf("invalid relabel source label: %s", l)
+		}
+	}
+
+	switch c.Action {
+	case relabelActionReplace, relabelActionHashMod, relabelActionLowercase:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires a target_label", c.Action)
+		}
+		if !labelNameRE.MatchString(c.TargetLabel) {
+			return fmt.Errorf("invalid relabel target label: %s", c.TargetLabel)
+		}
+	}
+	if c.Action == relabelActionHashMod && c.Modulus == 0 {
+		return fmt.Errorf("relabel action %s requires a non-zero modulus", c.Action)
+	}
+	if c.Action == relabelActionLabelDrop || c.Action == relabelActionLabelKeep {
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" {
+			return fmt.Errorf("relabel action %s only uses regex, source_labels and target_label must not be set", c.Action)
+		}
+	}
+	return nil
+}
+
+// relabel applies the given relabel configs in order to labels and returns the
+// resulting label set. The input labels are not modified.
+func relabel(labels prometheus.Labels, cfgs []*relabelConfig) prometheus.Labels {
+	if len(cfgs) == 0 {
+		return labels
+	}
+
+	out := make(prometheus.Labels, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+
+	for _, cfg := range cfgs {
+		values := make([]string, 0, len(cfg.SourceLabels))
+		for _, l := range cfg.SourceLabels {
+			values = append(values, out[l])
+		}
+		val := strings.Join(values, cfg.separator)
+
+		switch cfg.Action {
+		case relabelActionReplace:
+			indexes := cfg.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				continue
+			}
+			res := string(cfg.regex.ExpandString([]byte{}, cfg.replacement, val, indexes))
+			if res == "" {
+				delete(out, cfg.TargetLabel)
+				continue
+			}
+			out[cfg.TargetLabel] = res
+		case relabelActionLowercase:
+			out[cfg.TargetLabel] = strings.ToLower(val)
+		case relabelActionHashMod:
+			sum := md5.Sum([]byte(val))
+			mod := binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus
+			out[cfg.TargetLabel] = fmt.Sprintf("%d", mod)
+		case relabelActionLabelDrop:
+			for k := range out {
+				if cfg.regex.MatchString(k) {
+					delete(out, k)
+				}
+			}
+		case relabelActionLabelKeep:
+			for k := range out {
+				if !cfg.regex.MatchString(k) {
+					delete(out, k)
+				}
+			}
+		default:
+			panic(fmt.Sprintf("unknown relabel action '%s'", cfg.Action))
+		}
+	}
+	return out
+}
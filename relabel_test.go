@@ -0,0 +1,250 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRelabel(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config string
+		in     prometheus.Labels
+		out    prometheus.Labels
+	}{
+		{
+			name: "replace",
+			config: `
+relabel:
+- source_labels: [host]
+  regex: "([^.]+)\\..*"
+  target_label: host
+`,
+			in:  prometheus.Labels{"host": "web01.example.com"},
+			out: prometheus.Labels{"host": "web01"},
+		},
+		{
+			name: "replace with multiple source labels",
+			config: `
+relabel:
+- source_labels: [env, region]
+  separator: "-"
+  target_label: location
+`,
+			in:  prometheus.Labels{"env": "prod", "region": "eu"},
+			out: prometheus.Labels{"env": "prod", "region": "eu", "location": "prod-eu"},
+		},
+		{
+			name: "replace not matching",
+			config: `
+relabel:
+- source_labels: [host]
+  regex: "db.*"
+  replacement: database
+  target_label: role
+`,
+			in:  prometheus.Labels{"host": "web01"},
+			out: prometheus.Labels{"host": "web01"},
+		},
+		{
+			name: "replace with empty value deletes",
+			config: `
+relabel:
+- replacement: ""
+  target_label: host
+`,
+			in:  prometheus.Labels{"host": "web01", "env": "prod"},
+			out: prometheus.Labels{"env": "prod"},
+		},
+		{
+			name: "labeldrop",
+			config: `
+relabel:
+- action: labeldrop
+  regex: "request_.*"
+`,
+			in:  prometheus.Labels{"request_id": "1234", "request_path": "/", "env": "prod"},
+			out: prometheus.Labels{"env": "prod"},
+		},
+		{
+			name: "labelkeep",
+			config: `
+relabel:
+- action: labelkeep
+  regex: "env|service"
+`,
+			in:  prometheus.Labels{"request_id": "1234", "service": "api", "env": "prod"},
+			out: prometheus.Labels{"service": "api", "env": "prod"},
+		},
+		{
+			name: "hashmod",
+			config: `
+relabel:
+- action: hashmod
+  source_labels: [user]
+  modulus: 8
+  target_label: shard
+- action: labeldrop
+  regex: user
+`,
+			in:  prometheus.Labels{"user": "alice"},
+			out: prometheus.Labels{"shard": "4"},
+		},
+		{
+			name: "lowercase",
+			config: `
+relabel:
+- action: lowercase
+  source_labels: [Service]
+  target_label: service
+- action: labeldrop
+  regex: Service
+`,
+			in:  prometheus.Labels{"Service": "UserAPI"},
+			out: prometheus.Labels{"service": "userapi"},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		mapper := metricMapper{}
+		if err := mapper.initFromYAMLString(scenario.config); err != nil {
+			t.Fatalf("%s: Config load error: %s", scenario.name, err)
+		}
+		in := prometheus.Labels{}
+		for k, v := range scenario.in {
+			in[k] = v
+		}
+		out := relabel(in, mapper.globalRelabelConfigs())
+		if !reflect.DeepEqual(out, scenario.out) {
+			t.Fatalf("%s: Expected labels %v, got %v", scenario.name, scenario.out, out)
+		}
+		if !reflect.DeepEqual(in, scenario.in) {
+			t.Fatalf("%s: Input labels were modified: %v", scenario.name, in)
+		}
+	}
+}
+
+func TestRelabelConfigValidation(t *testing.T) {
+	scenarios := []struct {
+		config    string
+		configBad bool
+	}{
+		{
+			config: `
+relabel:
+- action: bogus
+`,
+			configBad: true,
+		},
+		{
+			config: `
+relabel:
+- source_labels: [host]
+`,
+			configBad: true,
+		},
+		{
+			config: `
+relabel:
+- action: hashmod
+  source_labels: [host]
+  target_label: shard
+`,
+			configBad: true,
+		},
+		{
+			config: `
+relabel:
+- action: labeldrop
+  source_labels: [host]
+`,
+			configBad: true,
+		},
+		{
+			config: `
+relabel:
+- target_label: host
+  regex: "(foo"
+`,
+			configBad: true,
+		},
+		{
+			config: `
+mappings:
+- match: test.*
+  name: "foo"
+  relabel:
+  - action: labeldrop
+    source_labels: [host]
+`,
+			configBad: true,
+		},
+		{
+			config: `
+defaults:
+  label_precedence: nobody
+`,
+			configBad: true,
+		},
+		{
+			config: `
+defaults:
+  label_precedence: tags
+mappings:
+- match: test.*
+  name: "foo"
+  label_precedence: mapping
+  relabel:
+  - action: labeldrop
+    regex: host
+`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		mapper := metricMapper{}
+		err := mapper.initFromYAMLString(scenario.config)
+		if err != nil && !scenario.configBad {
+			t.Fatalf("%d. Config load error: %s %s", i, scenario.config, err)
+		}
+		if err == nil && scenario.configBad {
+			t.Fatalf("%d. Expected bad config, but loaded ok: %s", i, scenario.config)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	tags := map[string]string{"job": "from_tag", "env": "prod"}
+	mapped := prometheus.Labels{"job": "from_mapping"}
+
+	got := mergeLabels(tags, mapped, labelPrecedenceMapping)
+	want := prometheus.Labels{"job": "from_mapping", "env": "prod"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected labels %v, got %v", want, got)
+	}
+
+	got = mergeLabels(tags, mapped, labelPrecedenceTags)
+	want = prometheus.Labels{"job": "from_tag", "env": "prod"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected labels %v, got %v", want, got)
+	}
+
+	if tags["job"] != "from_tag" {
+		t.Fatalf("Event tags were modified: %v", tags)
+	}
+}
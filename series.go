@@ -0,0 +1,381 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// seriesInfo describes a series created by the exporter, along with the
+// settings it was created with.
+type seriesInfo struct {
+	name        string
+	labels      prometheus.Labels
+	help        string
+	unmapped    bool
+	neutralised bool
+	overflow    bool
+	mapping     string // The identity of the mapping, if any.
+	outputType  outputType
+	buckets     []float64
+	quantiles   []metricObjective
+	// origin is the event that created the series. It is mapped again when
+	// the configuration changes.
+	origin Event
+	metric prometheus.Collector
+	// lastUpdate is the time of the last event recorded in the series, which
+	// is removed once it is older than ttl.
+	lastUpdate time.Time
+	ttl        time.Duration
+	element    *list.Element // The series' element of the LRU list.
+	// expiryElement is the series' element of the expiry list of its TTL.
+	expiryElement *list.Element
+}
+
+// recordSeries remembers the series an event was recorded in, or updates the
+// time of its last event if it is already known.
+func (b *Exporter) recordSeries(event Event, m *mappedEvent, metric prometheus.Collector) {
+	now := time.Now()
+	hash := hashNameAndLabels(m.name, m.labels)
+	if s, ok := b.series[hash]; ok {
+		s.lastUpdate = now
+		b.lru.MoveToFront(s.element)
+		if s.expiryElement != nil {
+			b.expiring[s.ttl].MoveToFront(s.expiryElement)
+		}
+		return
+	}
+
+	s := &seriesInfo{
+		name:        m.name,
+		labels:      m.labels,
+		help:        m.help,
+		unmapped:    !m.present,
+		neutralised: m.neutralised,
+		overflow:    m.overflow,
+		outputType:  m.outputType,
+		origin:      event,
+		metric:      metric,
+		lastUpdate:  now,
+		ttl:         m.mapping.TTL,
+	}
+	if s.unmapped {
+		b.unmappedNames[s.name]++
+	} else {
+		s.mapping = m.mapping.identity()
+		b.seriesByMapping[s.mapping]++
+	}
+	b.seriesByName[s.name]++
+	switch m.outputType {
+	case outputTypeHistogram:
+		s.buckets = b.Histograms.buckets(m.mapping)
+	case outputTypeSummary:
+		s.quantiles = b.Summaries.quantiles(m.mapping)
+	}
+	s.element = b.lru.PushFront(hash)
+	b.series[hash] = s
+	b.trackExpiry(hash, s)
+	b.evictSeries()
+}
+
+// evictSeries removes the least recently updated series while there are more
+// than maxSeries.
+func (b *Exporter) evictSeries() {
+	for b.maxSeries > 0 && len(b.series) > b.maxSeries {
+		hash := b.lru.Back().Value.(uint64)
+		s := b.series[hash]
+		b.removeSeries(hash, s)
+		seriesEvicted.WithLabelValues(string(s.outputType)).Inc()
+	}
+}
+
+// forgetSeries removes a series from its container, so that the next event
+// for it creates it again.
+func (b *Exporter) forgetSeries(hash uint64, s *seriesInfo) {
+	switch s.outputType {
+	case outputTypeCounter:
+		delete(b.Counters.Elements, hash)
+	case outputTypeGauge:
+		delete(b.Gauges.Elements, hash)
+	case outputTypeHistogram:
+		delete(b.Histograms.Elements, hash)
+	case outputTypeSummary:
+		delete(b.Summaries.Elements, hash)
+	default:
+		panic(fmt.Sprintf("unknown output type '%s'", s.outputType))
+	}
+	delete(b.series, hash)
+	b.lru.Remove(s.element)
+	b.untrackExpiry(s)
+	if s.unmapped {
+		decrement(b.unmappedNames, s.name)
+	} else {
+		decrement(b.seriesByMapping, s.mapping)
+	}
+	decrement(b.seriesByName, s.name)
+}
+
+// removeSeries unregisters a series and forgets it.
+func (b *Exporter) removeSeries(hash uint64, s *seriesInfo) {
+	b.registry.Unregister(s.metric)
+	b.forgetSeries(hash, s)
+}
+
+// deleteSeries removes the series matched by any of the selectors and returns
+// how many were removed.
+func (b *Exporter) deleteSeries(selectors []seriesSelector) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	deleted := 0
+	for hash, s := range b.series {
+		for _, selector := range selectors {
+			if selector.matches(s.name, s.labels) {
+				b.removeSeries(hash, s)
+				seriesDeleted.WithLabelValues(string(s.outputType)).Inc()
+				deleted++
+				break
+			}
+		}
+	}
+	return deleted
+}
+
+// handleDelete removes the series a DeleteEvent is mapped to, if deletion
+// lines are enabled.
+func (b *Exporter) handleDelete(event *DeleteEvent) {
+	if !b.deleteLines {
+		log.Debugf("Ignoring deletion of %q, as deletion lines are disabled", event.MetricName())
+		eventStats.WithLabelValues("illegal").Inc()
+		return
+	}
+	eventStats.WithLabelValues("delete").Inc()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	m, ok := b.mapEvent(event)
+	if !ok {
+		return
+	}
+	hash := hashNameAndLabels(m.name, m.labels)
+	if s, ok := b.series[hash]; ok {
+		b.removeSeries(hash, s)
+		seriesDeleted.WithLabelValues(string(s.outputType)).Inc()
+	}
+}
+
+// trackExpiry adds a series with a TTL to the expiry list of its TTL, behind
+// the series updated more recently, and starts checking for expired series if
+// this is the first one.
+func (b *Exporter) trackExpiry(hash uint64, s *seriesInfo) {
+	if s.ttl <= 0 {
+		return
+	}
+	l, ok := b.expiring[s.ttl]
+	if !ok {
+		l = list.New()
+		b.expiring[s.ttl] = l
+	}
+	e := l.Front()
+	for e != nil && b.series[e.Value.(uint64)].lastUpdate.After(s.lastUpdate) {
+		e = e.Next()
+	}
+	if e == nil {
+		s.expiryElement = l.PushBack(hash)
+	} else {
+		s.expiryElement = l.InsertBefore(hash, e)
+	}
+
+	if b.expiryInterval > 0 {
+		b.expiryOnce.Do(func() {
+			go b.expireSeriesEvery(b.expiryInterval)
+		})
+	}
+}
+
+// untrackExpiry removes a series from the expiry list of its TTL, if any.
+func (b *Exporter) untrackExpiry(s *seriesInfo) {
+	if s.expiryElement == nil {
+		return
+	}
+	l := b.expiring[s.ttl]
+	l.Remove(s.expiryElement)
+	s.expiryElement = nil
+	if l.Len() == 0 {
+		delete(b.expiring, s.ttl)
+	}
+}
+
+// expireSeries removes the series that received no events within their TTL.
+func (b *Exporter) expireSeries(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ttl, l := range b.expiring {
+		for e := l.Back(); e != nil; e = l.Back() {
+			hash := e.Value.(uint64)
+			s := b.series[hash]
+			if now.Sub(s.lastUpdate) < ttl {
+				break
+			}
+			b.removeSeries(hash, s)
+			seriesExpired.WithLabelValues(string(s.outputType)).Inc()
+		}
+	}
+}
+
+// expireSeriesEvery checks for expired series at the given interval.
+func (b *Exporter) expireSeriesEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		b.expireSeries(now)
+	}
+}
+
+// decrement decreases a series count, removing it once it reaches zero.
+func decrement(counts map[string]int, key string) {
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// reconcile applies the current mapping configuration to all series created
+// so far. A series is removed if its mapping now drops it or maps it to a
+// different name, label set or type; new events recreate it as configured. A
+// series whose help text, buckets or quantiles changed is recreated right
+// away. Counters and gauges keep their value, while histograms and summaries
+// start over.
+func (b *Exporter) reconcile() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	type recreation struct {
+		origin Event
+		m      *mappedEvent
+		value  float64
+	}
+	var (
+		recreations []recreation
+		changed     bool
+	)
+
+	for hash, s := range b.series {
+		m, ok := b.mapEvent(s.origin)
+		if ok && s.neutralised {
+			m.labels, _ = b.cardinality.apply(b.mapper.labelCardinality(), m.name, m.labels)
+			m.neutralised = true
+		}
+		if ok && s.overflow {
+			m.labels = overflowLabels(m.labels)
+			m.overflow = true
+		}
+		if !ok || m.present == s.unmapped || m.name != s.name || m.outputType != s.outputType || !reflect.DeepEqual(m.labels, s.labels) {
+			b.forgetSeries(hash, s)
+			seriesReconciled.WithLabelValues("removed").Inc()
+			changed = true
+			continue
+		}
+		if s.ttl != m.mapping.TTL {
+			b.untrackExpiry(s)
+			s.ttl = m.mapping.TTL
+			b.trackExpiry(hash, s)
+		}
+		if id := m.mapping.identity(); m.present && id != s.mapping {
+			// The mapping moved, so its series count follows it.
+			decrement(b.seriesByMapping, s.mapping)
+			b.seriesByMapping[id]++
+			s.mapping = id
+		}
+
+		var buckets []float64
+		var quantiles []metricObjective
+		switch m.outputType {
+		case outputTypeHistogram:
+			buckets = b.Histograms.buckets(m.mapping)
+		case outputTypeSummary:
+			quantiles = b.Summaries.quantiles(m.mapping)
+		}
+		if m.help == s.help && reflect.DeepEqual(buckets, s.buckets) && reflect.DeepEqual(quantiles, s.quantiles) {
+			continue
+		}
+
+		r := recreation{origin: s.origin, m: m}
+		if metric, ok := s.metric.(prometheus.Metric); ok {
+			pb := &dto.Metric{}
+			if err := metric.Write(pb); err == nil {
+				r.value = pb.GetCounter().GetValue() + pb.GetGauge().GetValue()
+			}
+		}
+		b.forgetSeries(hash, s)
+		recreations = append(recreations, r)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	// Start over with a fresh registry holding the unchanged series, as the
+	// old one would reject changed help texts and label names.
+	collectors := make([]prometheus.Collector, 0, len(b.series))
+	for _, s := range b.series {
+		collectors = append(collectors, s.metric)
+	}
+	failed := b.registry.reset(collectors)
+	for hash, s := range b.series {
+		if err, ok := failed[s.metric]; ok {
+			log.Debugf(regErrF, s.name, err)
+			b.forgetSeries(hash, s)
+			seriesReconciled.WithLabelValues("failed").Inc()
+		}
+	}
+
+	for _, r := range recreations {
+		var (
+			metric prometheus.Collector
+			err    error
+		)
+		switch r.m.outputType {
+		case outputTypeCounter:
+			var counter prometheus.Counter
+			if counter, err = b.Counters.Get(r.m.name, r.m.labels, r.m.help); err == nil {
+				counter.Add(r.value)
+				metric = counter
+			}
+		case outputTypeGauge:
+			var gauge prometheus.Gauge
+			if gauge, err = b.Gauges.Get(r.m.name, r.m.labels, r.m.help); err == nil {
+				gauge.Set(r.value)
+				metric = gauge
+			}
+		case outputTypeHistogram:
+			metric, err = b.Histograms.Get(r.m.name, r.m.labels, r.m.help, r.m.mapping)
+		case outputTypeSummary:
+			metric, err = b.Summaries.Get(r.m.name, r.m.labels, r.m.help, r.m.mapping)
+		}
+		if err != nil {
+			log.Debugf(regErrF, r.m.name, err)
+			seriesReconciled.WithLabelValues("failed").Inc()
+			continue
+		}
+		b.recordSeries(r.origin, r.m, metric)
+		seriesReconciled.WithLabelValues("recreated").Inc()
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestReconcile(t *testing.T) {
+	mapper := &metricMapper{}
+	err := mapper.initFromYAMLString(`---
+mappings:
+- match: reconcile.counter.*
+  name: "reconcile_counter_total"
+  help: "Old help."
+  labels:
+    kind: "$1"
+- match: reconcile.histogram.*
+  timer_type: histogram
+  buckets: [ 1 ]
+  name: "reconcile_histogram_seconds"
+- match: reconcile.dropped.*
+  name: "reconcile_dropped_total"
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+
+	listen := func(events Events) {
+		c := make(chan Events, 1)
+		c <- events
+		close(c)
+		ex.Listen(c)
+	}
+	listen(Events{
+		&CounterEvent{metricName: "reconcile.counter.a", value: 3},
+		&TimerEvent{metricName: "reconcile.histogram.a", value: 500},
+		&CounterEvent{metricName: "reconcile.dropped.a", value: 1},
+	})
+
+	err = mapper.initFromYAMLString(`---
+mappings:
+- match: reconcile.counter.*
+  name: "reconcile_counter_total"
+  help: "New help."
+  labels:
+    kind: "$1"
+- match: reconcile.histogram.*
+  timer_type: histogram
+  buckets: [ 1, 2 ]
+  name: "reconcile_histogram_seconds"
+- match: reconcile.dropped.*
+  name: "reconcile_dropped_total"
+  action: drop
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex.reconcile()
+
+	counter, ok := ex.Counters.Elements[hashNameAndLabels("reconcile_counter_total", prometheus.Labels{"kind": "a"})]
+	if !ok {
+		t.Fatalf("Counter was not recreated")
+	}
+	if !strings.Contains(counter.Desc().String(), `"New help."`) {
+		t.Fatalf("Counter help was not updated: %s", counter.Desc())
+	}
+	m := &dto.Metric{}
+	counter.Write(m)
+	if got := m.GetCounter().GetValue(); got != 3 {
+		t.Fatalf("Expected counter to keep its value 3, got %f", got)
+	}
+
+	histogram, ok := ex.Histograms.Elements[hashNameAndLabels("reconcile_histogram_seconds", prometheus.Labels{})]
+	if !ok {
+		t.Fatalf("Histogram was not recreated")
+	}
+	m = &dto.Metric{}
+	histogram.Write(m)
+	if got := len(m.GetHistogram().GetBucket()); got != 2 {
+		t.Fatalf("Expected histogram with 2 buckets, got %d", got)
+	}
+
+	if _, ok := ex.Counters.Elements[hashNameAndLabels("reconcile_dropped_total", prometheus.Labels{})]; ok {
+		t.Fatalf("Series of a dropped mapping was not removed")
+	}
+
+	// New label sets no longer conflict with the recreated series.
+	before := conflicts(t, "counter")
+	listen(Events{
+		&CounterEvent{metricName: "reconcile.counter.b", value: 1},
+	})
+	if conflicts(t, "counter") != before {
+		t.Fatalf("New series conflicted with the recreated series")
+	}
+}
+
+func conflicts(t *testing.T, eventType string) float64 {
+	m := &dto.Metric{}
+	if err := conflictingEventStats.WithLabelValues(eventType).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestExpireSeries(t *testing.T) {
+	mapper := &metricMapper{}
+	err := mapper.initFromYAMLString(`---
+defaults:
+  ttl: 1m
+mappings:
+- match: expire.alpha
+  name: "alpha_total"
+  ttl: 10s
+- match: expire.beta
+  name: "beta_total"
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+
+	listen := func(events Events) {
+		c := make(chan Events, 1)
+		c <- events
+		close(c)
+		ex.Listen(c)
+	}
+	events := Events{
+		&CounterEvent{metricName: "expire.alpha", value: 1},
+		&CounterEvent{metricName: "expire.beta", value: 1},
+		&GaugeEvent{metricName: "expire.gamma", value: 1},
+	}
+	listen(events)
+	start := time.Now()
+
+	ex.expireSeries(start.Add(30 * time.Second))
+	if got, expected := gatherSeries(t, ex.gatherer(false)), []string{"beta_total", "expire_gamma"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v after 30s, got %v", expected, got)
+	}
+	if len(ex.Counters.Elements) != 1 {
+		t.Fatalf("Expected the expired counter to be removed from its container")
+	}
+
+	// An expired series is created again by the next event.
+	listen(events[:1])
+	if got, expected := gatherSeries(t, ex.gatherer(false)), []string{"alpha_total", "beta_total", "expire_gamma"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v after a new event, got %v", expected, got)
+	}
+
+	ex.expireSeries(start.Add(2 * time.Minute))
+	if got := gatherSeries(t, ex.gatherer(false)); len(got) != 0 {
+		t.Fatalf("Expected all series to expire after 2m, got %v", got)
+	}
+	if len(ex.series) != 0 || len(ex.Counters.Elements) != 0 || len(ex.Gauges.Elements) != 0 || len(ex.expiring) != 0 {
+		t.Fatalf("Expected no series to be left")
+	}
+
+	// A reload moves the series to the expiry list of their new TTL.
+	listen(events)
+	start = time.Now()
+	err = mapper.initFromYAMLString(`---
+defaults:
+  ttl: 3m
+mappings:
+- match: expire.alpha
+  name: "alpha_total"
+  ttl: 5m
+- match: expire.beta
+  name: "beta_total"
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex.reconcile()
+	if len(ex.expiring) != 2 || ex.expiring[5*time.Minute].Len() != 1 || ex.expiring[3*time.Minute].Len() != 2 {
+		t.Fatalf("Expected one series with a TTL of 5m and two with 3m, got %v", ex.expiring)
+	}
+	ex.expireSeries(start.Add(2 * time.Minute))
+	if got := gatherSeries(t, ex.gatherer(false)); len(got) != 3 {
+		t.Fatalf("Expected no series to expire after 2m with the new TTLs, got %v", got)
+	}
+	ex.expireSeries(start.Add(4 * time.Minute))
+	if got, expected := gatherSeries(t, ex.gatherer(false)), []string{"alpha_total"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v after reloading, got %v", expected, got)
+	}
+
+	if err := mapper.initFromYAMLString("mappings:\n- match: expire.alpha\n  name: alpha_total\n  ttl: -1s\n"); err == nil || !strings.Contains(err.Error(), "ttl must not be negative") {
+		t.Fatalf("Expected negative TTL error, got %v", err)
+	}
+}
+
+func TestEvictSeries(t *testing.T) {
+	mapper := &metricMapper{}
+	err := mapper.initFromYAMLString(`---
+mappings:
+- match: evict.*
+  name: "evict_${1}_total"
+  ttl: 1m
+`)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+	ex.maxSeries = 2
+
+	listen := func(events Events) {
+		c := make(chan Events, 1)
+		c <- events
+		close(c)
+		ex.Listen(c)
+	}
+	listen(Events{
+		&CounterEvent{metricName: "evict.alpha", value: 1},
+		&CounterEvent{metricName: "evict.beta", value: 1},
+		&CounterEvent{metricName: "evict.alpha", value: 1},
+		&GaugeEvent{metricName: "evict.gamma", value: 1},
+	})
+
+	// beta is the least recently updated series.
+	if got, expected := gatherSeries(t, ex.gatherer(false)), []string{"evict_alpha_total", "evict_gamma_total"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v, got %v", expected, got)
+	}
+	if len(ex.Counters.Elements) != 1 || ex.lru.Len() != 2 {
+		t.Fatalf("Expected the evicted counter to be removed")
+	}
+
+	// Eviction works along with expiry.
+	ex.expireSeries(time.Now().Add(2 * time.Minute))
+	if len(ex.series) != 0 || ex.lru.Len() != 0 {
+		t.Fatalf("Expected all series to expire, got %d series and %d LRU entries", len(ex.series), ex.lru.Len())
+	}
+	listen(Events{&CounterEvent{metricName: "evict.beta", value: 1}})
+	if got, expected := gatherSeries(t, ex.gatherer(false)), []string{"evict_beta_total"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v, got %v", expected, got)
+	}
+}
+
+// TestReloadWhileRecording is meant for the race detector: unmapped series
+// take their type, unit, quantiles and TTL from the defaults, which a reload
+// replaces.
+func TestReloadWhileRecording(t *testing.T) {
+	mapper := &metricMapper{}
+	if err := mapper.initFromYAMLString("defaults:\n  ttl: 1m\nmappings: []\n"); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(mapper)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := mapper.initFromYAMLString("defaults:\n  ttl: 2m\n  timer_type: histogram\nmappings: []\n"); err != nil {
+				t.Errorf("Config load error: %s", err)
+				return
+			}
+		}
+	}()
+
+	c := make(chan Events, 50)
+	for i := 0; i < 50; i++ {
+		c <- Events{
+			&TimerEvent{metricName: "reload.timer", value: 1},
+			&CounterEvent{metricName: "reload.counter", value: 1},
+		}
+	}
+	close(c)
+	ex.Listen(c)
+	<-done
+}
@@ -0,0 +1,295 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// snapshotVersion is the version of the snapshot file format.
+const snapshotVersion = 1
+
+// snapshot holds the state of the counters, gauges and histograms created
+// from StatsD events. Summaries can't be restored and are left out.
+type snapshot struct {
+	Version int              `json:"version"`
+	Series  []snapshotSeries `json:"series"`
+}
+
+type snapshotSeries struct {
+	Name        string             `json:"name"`
+	Labels      prometheus.Labels  `json:"labels"`
+	Type        outputType         `json:"type"`
+	Neutralised bool               `json:"neutralised,omitempty"`
+	Overflow    bool               `json:"overflow,omitempty"`
+	Origin      snapshotEvent      `json:"origin"`
+	Value       float64            `json:"value,omitempty"`
+	Histogram   *snapshotHistogram `json:"histogram,omitempty"`
+}
+
+// snapshotEvent describes the event that created a series, so that it can be
+// reconciled with later configuration changes.
+type snapshotEvent struct {
+	MetricName string            `json:"metric_name"`
+	MetricType metricType        `json:"metric_type"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+func (e snapshotEvent) event() (Event, error) {
+	switch e.MetricType {
+	case metricTypeCounter:
+		return &CounterEvent{metricName: e.MetricName, labels: e.Labels}, nil
+	case metricTypeGauge:
+		return &GaugeEvent{metricName: e.MetricName, labels: e.Labels}, nil
+	case metricTypeTimer:
+		return &TimerEvent{metricName: e.MetricName, labels: e.Labels}, nil
+	default:
+		return nil, fmt.Errorf("unknown metric type %q", e.MetricType)
+	}
+}
+
+type snapshotHistogram struct {
+	Buckets []float64 `json:"buckets"`
+	// Counts are the cumulative counts of the buckets.
+	Counts []uint64 `json:"counts"`
+	Count  uint64   `json:"count"`
+	Sum    float64  `json:"sum"`
+}
+
+// restoredHistogram is a histogram that continues from a snapshot.
+type restoredHistogram struct {
+	prometheus.Histogram
+	state snapshotHistogram
+}
+
+func (h *restoredHistogram) Collect(ch chan<- prometheus.Metric) {
+	ch <- h
+}
+
+func (h *restoredHistogram) Write(m *dto.Metric) error {
+	if err := h.Histogram.Write(m); err != nil {
+		return err
+	}
+	count := m.Histogram.GetSampleCount() + h.state.Count
+	sum := m.Histogram.GetSampleSum() + h.state.Sum
+	m.Histogram.SampleCount = &count
+	m.Histogram.SampleSum = &sum
+	for i, b := range m.Histogram.Bucket {
+		c := b.GetCumulativeCount() + h.state.Counts[i]
+		b.CumulativeCount = &c
+	}
+	return nil
+}
+
+// restore creates a histogram that continues from a snapshot. The buckets must
+// not have changed since.
+func (c *HistogramContainer) restore(metricName string, labels prometheus.Labels, help string, mapping *metricMapping, state *snapshotHistogram) (prometheus.Histogram, error) {
+	buckets := c.buckets(mapping)
+	if state == nil || len(state.Counts) != len(state.Buckets) {
+		return nil, fmt.Errorf("invalid histogram state")
+	}
+	if !reflect.DeepEqual(buckets, state.Buckets) {
+		return nil, fmt.Errorf("buckets changed from %v to %v", state.Buckets, buckets)
+	}
+	hash := hashNameAndLabels(metricName, labels)
+	if _, ok := c.Elements[hash]; ok {
+		return nil, fmt.Errorf("series already exists")
+	}
+
+	histogram := &restoredHistogram{
+		Histogram: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:        metricName,
+				Help:        help,
+				ConstLabels: labels,
+				Buckets:     buckets,
+			}),
+		state: *state,
+	}
+	if err := c.registerer.Register(histogram); err != nil {
+		return nil, err
+	}
+	c.Elements[hash] = histogram
+	return histogram, nil
+}
+
+// snapshot returns the current state of all series but summaries.
+func (b *Exporter) snapshot() *snapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	snap := &snapshot{Version: snapshotVersion, Series: []snapshotSeries{}}
+	for _, s := range b.series {
+		metric, ok := s.metric.(prometheus.Metric)
+		if !ok || s.outputType == outputTypeSummary {
+			continue
+		}
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			log.Debugf("Error writing %q for the snapshot: %s", s.name, err)
+			continue
+		}
+
+		e := snapshotSeries{
+			Name:        s.name,
+			Labels:      s.labels,
+			Type:        s.outputType,
+			Neutralised: s.neutralised,
+			Overflow:    s.overflow,
+			Origin: snapshotEvent{
+				MetricName: s.origin.MetricName(),
+				MetricType: s.origin.MetricType(),
+				Labels:     s.origin.Labels(),
+			},
+		}
+		switch s.outputType {
+		case outputTypeCounter:
+			e.Value = pb.GetCounter().GetValue()
+		case outputTypeGauge:
+			e.Value = pb.GetGauge().GetValue()
+		case outputTypeHistogram:
+			h := &snapshotHistogram{
+				Count: pb.GetHistogram().GetSampleCount(),
+				Sum:   pb.GetHistogram().GetSampleSum(),
+			}
+			for _, bucket := range pb.GetHistogram().GetBucket() {
+				h.Buckets = append(h.Buckets, bucket.GetUpperBound())
+				h.Counts = append(h.Counts, bucket.GetCumulativeCount())
+			}
+			e.Histogram = h
+		}
+		snap.Series = append(snap.Series, e)
+	}
+	return snap
+}
+
+// writeSnapshot writes a snapshot of the series to a file, replacing it
+// atomically.
+func (b *Exporter) writeSnapshot(path string) error {
+	data, err := json.Marshal(b.snapshot())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// snapshotEvery writes a snapshot at the given interval.
+func (b *Exporter) snapshotEvery(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := b.writeSnapshot(path); err != nil {
+			log.Errorln("Error writing snapshot:", err)
+			snapshotWrites.WithLabelValues("failure").Inc()
+			continue
+		}
+		snapshotWrites.WithLabelValues("success").Inc()
+	}
+}
+
+// restoreSnapshot recreates the series of a snapshot file and returns how many
+// were restored. A missing file is not an error. Series the current
+// configuration maps differently are skipped.
+func (b *Exporter) restoreSnapshot(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	restored := 0
+	for _, e := range snap.Series {
+		if err := b.restoreSeries(e); err != nil {
+			log.Infof("Not restoring %q from the snapshot: %s", e.Name, err)
+			continue
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// restoreSeries recreates a single series of a snapshot, with the name and
+// labels it had, including those derived from its mapping.
+func (b *Exporter) restoreSeries(e snapshotSeries) error {
+	origin, err := e.Origin.event()
+	if err != nil {
+		return err
+	}
+	m, ok := b.mapEvent(origin)
+	if !ok {
+		return fmt.Errorf("dropped by the current configuration")
+	}
+	if m.name != e.Name || m.outputType != e.Type {
+		return fmt.Errorf("mapped to %q of type %s by the current configuration", m.name, m.outputType)
+	}
+	if e.Labels == nil {
+		e.Labels = prometheus.Labels{}
+	}
+	if !e.Neutralised && !e.Overflow && !reflect.DeepEqual(m.labels, e.Labels) {
+		return fmt.Errorf("labels changed from %v to %v", e.Labels, m.labels)
+	}
+	m.labels = e.Labels
+	m.neutralised = e.Neutralised
+	m.overflow = e.Overflow
+
+	var metric prometheus.Collector
+	switch e.Type {
+	case outputTypeCounter:
+		if e.Value < 0 {
+			return fmt.Errorf("negative counter value %v", e.Value)
+		}
+		var counter prometheus.Counter
+		if counter, err = b.Counters.Get(m.name, m.labels, m.help); err == nil {
+			counter.Add(e.Value)
+			metric = counter
+		}
+	case outputTypeGauge:
+		var gauge prometheus.Gauge
+		if gauge, err = b.Gauges.Get(m.name, m.labels, m.help); err == nil {
+			gauge.Set(e.Value)
+			metric = gauge
+		}
+	case outputTypeHistogram:
+		metric, err = b.Histograms.restore(m.name, m.labels, m.help, m.mapping, e.Histogram)
+	default:
+		return fmt.Errorf("unsupported type %s", e.Type)
+	}
+	if err != nil {
+		return err
+	}
+	b.recordSeries(origin, m, metric)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const snapshotTestConfig = `---
+mappings:
+- match: snapshot.*.requests
+  name: "snapshot_requests_total"
+  labels:
+    service: "$1"
+- match: snapshot.duration
+  timer_type: histogram
+  buckets: [ 0.1, 1 ]
+  name: "snapshot_duration_seconds"
+- match: snapshot.summary
+  name: "snapshot_summary_seconds"
+`
+
+func TestSnapshot(t *testing.T) {
+	f, err := ioutil.TempFile("", "statsd_exporter_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	newExporter := func(config string) *Exporter {
+		mapper := &metricMapper{}
+		if err := mapper.initFromYAMLString(config); err != nil {
+			t.Fatalf("Config load error: %s", err)
+		}
+		return NewExporter(mapper)
+	}
+	listen := func(ex *Exporter, events Events) {
+		c := make(chan Events, 1)
+		c <- events
+		close(c)
+		ex.Listen(c)
+	}
+	events := Events{
+		&CounterEvent{metricName: "snapshot.api.requests", value: 3, labels: map[string]string{"env": "prod"}},
+		&TimerEvent{metricName: "snapshot.duration", value: 50},
+		&TimerEvent{metricName: "snapshot.duration", value: 500},
+		&TimerEvent{metricName: "snapshot.summary", value: 1},
+		&GaugeEvent{metricName: "snapshot.version", value: 42},
+	}
+
+	ex := newExporter(snapshotTestConfig)
+	listen(ex, events)
+	if err := ex.writeSnapshot(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newExporter(snapshotTestConfig)
+	n, err := restored.restoreSnapshot(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 restored series, got %d", n)
+	}
+	expected := []string{
+		`snapshot_duration_seconds`,
+		`snapshot_requests_total{env="prod",service="api"}`,
+		`snapshot_version`,
+	}
+	if got := gatherSeries(t, restored.gatherer(false)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected series %v, got %v", expected, got)
+	}
+
+	value := func(ex *Exporter, name string, labels prometheus.Labels) *dto.Metric {
+		hash := hashNameAndLabels(name, labels)
+		m := &dto.Metric{}
+		if err := ex.series[hash].metric.(prometheus.Metric).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if got := value(restored, "snapshot_requests_total", prometheus.Labels{"env": "prod", "service": "api"}).GetCounter().GetValue(); got != 3 {
+		t.Fatalf("Expected restored counter value 3, got %v", got)
+	}
+	if got := value(restored, "snapshot_version", prometheus.Labels{}).GetGauge().GetValue(); got != 42 {
+		t.Fatalf("Expected restored gauge value 42, got %v", got)
+	}
+
+	// Restored series continue from their snapshot.
+	listen(restored, events)
+	h := value(restored, "snapshot_duration_seconds", prometheus.Labels{}).GetHistogram()
+	if h.GetSampleCount() != 4 || h.GetSampleSum() != 1.1 || h.GetBucket()[0].GetCumulativeCount() != 2 || h.GetBucket()[1].GetCumulativeCount() != 4 {
+		t.Fatalf("Unexpected histogram after restoring: %v", h)
+	}
+	if got := value(restored, "snapshot_requests_total", prometheus.Labels{"env": "prod", "service": "api"}).GetCounter().GetValue(); got != 6 {
+		t.Fatalf("Expected counter value 6, got %v", got)
+	}
+
+	// Series the configuration now maps differently are not restored.
+	changed := newExporter(`---
+mappings:
+- match: snapshot.*.requests
+  name: "snapshot_requests_total"
+  labels:
+    team: "$1"
+- match: snapshot.duration
+  timer_type: histogram
+  buckets: [ 0.5 ]
+  name: "snapshot_duration_seconds"
+`)
+	if n, err := changed.restoreSnapshot(f.Name()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 restored series, got %d (%v)", n, err)
+	}
+
+	// A missing snapshot is not an error.
+	if n, err := newExporter(snapshotTestConfig).restoreSnapshot(f.Name() + ".missing"); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to be restored from a missing snapshot, got %d (%v)", n, err)
+	}
+}
@@ -15,6 +15,7 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
 )
 
 var (
@@ -91,6 +92,28 @@ var (
 		},
 		[]string{"outcome"},
 	)
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configLastReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+	configInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_config_info",
+			Help: "Information about the currently loaded mapping configuration, always 1.",
+		},
+		[]string{"hash"},
+	)
+	seriesReconciled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_reconciled_total",
+			Help: "The number of series removed or recreated to apply configuration changes.",
+		},
+		[]string{"outcome"},
+	)
 	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "statsd_exporter_loaded_mappings",
 		Help: "The current number of configured metric mappings.",
@@ -102,20 +125,124 @@ var (
 		},
 		[]string{"type"},
 	)
+	eventsUnmappedByType = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_unmapped_by_type_total",
+			Help: "The total number of StatsD events no mapping was found for, by event type.",
+		},
+		[]string{"type"},
+	)
+	eventsUnmappedDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "statsd_exporter_events_unmapped_dropped_total",
+		Help: "The total number of StatsD events no mapping was found for that were dropped by the unmapped policy.",
+	})
+	mappingEventsMatched = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_mapping_events_matched_total",
+			Help: "The total number of StatsD events matched by a mapping.",
+		},
+		[]string{"mapping"},
+	)
+	mappingEventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_mapping_events_dropped_total",
+			Help: "The total number of StatsD events dropped by a mapping with action drop.",
+		},
+		[]string{"mapping"},
+	)
+	mappingLastMatch = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_mapping_last_match_timestamp_seconds",
+			Help: "Timestamp of the last StatsD event matched by a mapping.",
+		},
+		[]string{"mapping"},
+	)
+	seriesOverLimit = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_over_limit_total",
+			Help: "The total number of StatsD events that would have created a series beyond a series limit.",
+		},
+		[]string{"mapping", "metric", "limit", "action"},
+	)
+	labelsNeutralised = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_label_neutralised_timestamp_seconds",
+			Help: "Timestamp at which a label of a metric was neutralised for taking too many distinct values.",
+		},
+		[]string{"metric", "label", "action"},
+	)
+	seriesExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_expired_total",
+			Help: "The total number of series removed for receiving no events within their TTL.",
+		},
+		[]string{"type"},
+	)
+	seriesEvicted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_evicted_total",
+			Help: "The total number of least recently updated series removed to stay within the maximum number of live series.",
+		},
+		[]string{"type"},
+	)
+	seriesDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_deleted_total",
+			Help: "The total number of series deleted through the admin API or deletion lines.",
+		},
+		[]string{"type"},
+	)
+	snapshotWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_snapshot_writes_total",
+			Help: "The number of snapshot writes.",
+		},
+		[]string{"outcome"},
+	)
+	valuesOutOfBounds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_values_out_of_bounds_total",
+			Help: "The total number of StatsD values outside of the bounds of their mapping.",
+		},
+		[]string{"mapping", "action"},
+	)
 )
 
+// ownMetrics are the metrics the exporter exposes about itself.
+var ownMetrics = []prometheus.Collector{
+	version.NewCollector("statsd_exporter"),
+	eventStats,
+	eventsUnmapped,
+	eventsUnmappedByType,
+	eventsUnmappedDropped,
+	udpPackets,
+	tcpConnections,
+	tcpErrors,
+	tcpLineTooLong,
+	linesReceived,
+	samplesReceived,
+	sampleErrors,
+	tagsReceived,
+	tagErrors,
+	configLoads,
+	configLastReloadSuccessful,
+	configLastReloadSuccessTime,
+	configInfo,
+	seriesReconciled,
+	mappingsCount,
+	conflictingEventStats,
+	valuesOutOfBounds,
+	mappingEventsMatched,
+	mappingEventsDropped,
+	mappingLastMatch,
+	seriesOverLimit,
+	labelsNeutralised,
+	seriesExpired,
+	seriesEvicted,
+	seriesDeleted,
+	snapshotWrites,
+}
+
 func init() {
-	prometheus.MustRegister(eventStats)
-	prometheus.MustRegister(udpPackets)
-	prometheus.MustRegister(tcpConnections)
-	prometheus.MustRegister(tcpErrors)
-	prometheus.MustRegister(tcpLineTooLong)
-	prometheus.MustRegister(linesReceived)
-	prometheus.MustRegister(samplesReceived)
-	prometheus.MustRegister(sampleErrors)
-	prometheus.MustRegister(tagsReceived)
-	prometheus.MustRegister(tagErrors)
-	prometheus.MustRegister(configLoads)
-	prometheus.MustRegister(mappingsCount)
-	prometheus.MustRegister(conflictingEventStats)
+	prometheus.MustRegister(ownMetrics...)
 }
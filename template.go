@@ -0,0 +1,158 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+const (
+	templateLeftDelim  = "{{"
+	templateRightDelim = "}}"
+)
+
+var (
+	matchReferenceRE = regexp.MustCompile(`\$\{?(\d+)\}?`)
+	namedReferenceRE = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+	templateFuncs = template.FuncMap{
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"snake_case": snakeCase,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"default": func(def, s string) string {
+			if s == "" {
+				return def
+			}
+			return s
+		},
+	}
+)
+
+// templateData is the data available to name and label templates.
+type templateData struct {
+	// Metric is the original StatsD metric name.
+	Metric string
+	// Matches holds the whole match at index 0, followed by the capture
+	// groups of the mapping's match expression.
+	Matches []string
+	// Groups holds the named capture groups of regex match expressions.
+	Groups map[string]string
+	// Tags holds the DogStatsD tags of the event.
+	Tags map[string]string
+}
+
+// isTemplate reports whether expr uses the template language rather than
+// plain $n substitution.
+func isTemplate(expr string) bool {
+	return strings.Contains(expr, templateLeftDelim)
+}
+
+// compileTemplate parses a name or label expression. $n and ${n} references
+// are rewritten into lookups of the n-th match, and ${name} references into
+// lookups of named capture groups, so they can be used both in the literal
+// text and as arguments inside template actions.
+func compileTemplate(name, expr string) (*template.Template, error) {
+	var buf bytes.Buffer
+	rest := expr
+	for {
+		start := strings.Index(rest, templateLeftDelim)
+		if start < 0 {
+			buf.WriteString(rewriteReferences(rest, false))
+			break
+		}
+		buf.WriteString(rewriteReferences(rest[:start], false))
+		rest = rest[start:]
+
+		end := strings.Index(rest, templateRightDelim)
+		if end < 0 {
+			// Leave it to the template parser to report the unclosed action.
+			buf.WriteString(rest)
+			break
+		}
+		end += len(templateRightDelim)
+		buf.WriteString(rewriteReferences(rest[:end], true))
+		rest = rest[end:]
+	}
+
+	return template.New(name).
+		Funcs(templateFuncs).
+		Option("missingkey=zero").
+		Parse(buf.String())
+}
+
+// rewriteReferences rewrites the match references in s into template
+// lookups. Inside of actions, they become parenthesized pipelines.
+func rewriteReferences(s string, inAction bool) string {
+	matches, groups := templateLeftDelim+"index .Matches $1"+templateRightDelim, templateLeftDelim+`index .Groups "$1"`+templateRightDelim
+	if inAction {
+		matches, groups = "(index .Matches $1)", `(index .Groups "$1")`
+	}
+	s = namedReferenceRE.ReplaceAllString(s, groups)
+	return matchReferenceRE.ReplaceAllString(s, matches)
+}
+
+// executeTemplate renders t for the given metric, its matches, named capture
+// groups and tags.
+func executeTemplate(t *template.Template, metric string, matches []string, groups, tags map[string]string) (string, error) {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	if groups == nil {
+		groups = map[string]string{}
+	}
+	var buf bytes.Buffer
+	err := t.Execute(&buf, templateData{
+		Metric:  metric,
+		Matches: matches,
+		Groups:  groups,
+		Tags:    tags,
+	})
+	return buf.String(), err
+}
+
+// snakeCase converts camelCase, PascalCase and dot, dash or space separated
+// strings to snake_case.
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var buf bytes.Buffer
+	for i, r := range runes {
+		switch {
+		case r == '.' || r == '-' || r == ' ' || r == '_':
+			if buf.Len() > 0 && !strings.HasSuffix(buf.String(), "_") {
+				buf.WriteRune('_')
+			}
+		case unicode.IsUpper(r):
+			// Start a new word on a lower-to-upper transition and at the
+			// end of an acronym, e.g. "HTTPServer" becomes "http_server".
+			if i > 0 && buf.Len() > 0 && !strings.HasSuffix(buf.String(), "_") {
+				prev := runes[i-1]
+				nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+					buf.WriteRune('_')
+				}
+			}
+			buf.WriteRune(unicode.ToLower(r))
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return strings.TrimSuffix(buf.String(), "_")
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSnakeCase(t *testing.T) {
+	scenarios := map[string]string{
+		"":                 "",
+		"requestDuration":  "request_duration",
+		"RequestDuration":  "request_duration",
+		"HTTPServerErrors": "http_server_errors",
+		"getUserID":        "get_user_id",
+		"already_snake":    "already_snake",
+		"with.dots-dashes": "with_dots_dashes",
+		"v2Api":            "v2_api",
+		"trailing.":        "trailing",
+	}
+
+	for in, want := range scenarios {
+		if got := snakeCase(in); want != got {
+			t.Errorf("expected `%s` to be converted to `%s`, got `%s`", in, want, got)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	config := `---
+mappings:
+- match: app.*.*
+  name: '{{ snake_case $1 }}_{{ $2 | trimPrefix "num" | lower }}'
+  labels:
+    service: '{{ .Tags.service | default "unknown" }}'
+    env: '{{ .Tags.env | upper }}'
+    metric: '{{ replace "." "_" .Metric }}'
+    plain: "$1"
+- match: web\.(\w+)
+  match_type: regex
+  name: "web_{{ lower $1 }}_total"
+`
+	scenarios := []struct {
+		metric string
+		tags   map[string]string
+		name   string
+		labels map[string]string
+	}{
+		{
+			metric: "app.requestDuration.numSeconds",
+			tags:   map[string]string{"service": "api", "env": "prod"},
+			name:   "request_duration_seconds",
+			labels: map[string]string{
+				"service": "api",
+				"env":     "PROD",
+				"metric":  "app_requestDuration_numSeconds",
+				"plain":   "requestDuration",
+			},
+		},
+		{
+			metric: "app.cacheHits.Count",
+			name:   "cache_hits_count",
+			labels: map[string]string{
+				"service": "unknown",
+				"env":     "",
+				"metric":  "app_cacheHits_Count",
+				"plain":   "cacheHits",
+			},
+		},
+		{
+			metric: "web.Requests",
+			name:   "web_requests_total",
+			labels: map[string]string{},
+		},
+	}
+
+	mapper := metricMapper{}
+	if err := mapper.initFromYAMLString(config); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	for i, scenario := range scenarios {
+		m, labels, present := mapper.getMapping(scenario.metric, metricTypeCounter, scenario.tags)
+		if !present {
+			t.Fatalf("%d: Expected mapping to be present", i)
+		}
+		if m.Name != scenario.name {
+			t.Fatalf("%d: Expected name %v, got %v", i, scenario.name, m.Name)
+		}
+		if len(labels) != len(scenario.labels) {
+			t.Fatalf("%d: Expected %d labels, got %d", i, len(scenario.labels), len(labels))
+		}
+		for label, value := range labels {
+			if scenario.labels[label] != value {
+				t.Fatalf("%d: Expected labels %v, got %v", i, scenario.labels, labels)
+			}
+		}
+	}
+
+	badConfigs := []string{
+		`---
+mappings:
+- match: test.*
+  name: "{{ lower $1 "
+`,
+		`---
+mappings:
+- match: test.*
+  name: "{{ nosuchfunc $1 }}"
+`,
+		`---
+mappings:
+- match: test.*
+  name: "foo"
+  labels:
+    bar: "{{ .Tags.x "
+`,
+	}
+	for i, config := range badConfigs {
+		if err := mapper.initFromYAMLString(config); err == nil {
+			t.Fatalf("%d: Expected bad config, but loaded ok: %s", i, config)
+		}
+	}
+}
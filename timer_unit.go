@@ -0,0 +1,67 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// timerUnit is the unit in which StatsD clients send timer values.
+type timerUnit string
+
+const (
+	timerUnitNanoseconds  timerUnit = "ns"
+	timerUnitMicroseconds timerUnit = "us"
+	timerUnitMilliseconds timerUnit = "ms"
+	timerUnitSeconds      timerUnit = "s"
+	timerUnitDefault      timerUnit = ""
+)
+
+func (u *timerUnit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch timerUnit(v) {
+	case timerUnitNanoseconds:
+		*u = timerUnitNanoseconds
+	case timerUnitMicroseconds:
+		*u = timerUnitMicroseconds
+	case timerUnitMilliseconds:
+		*u = timerUnitMilliseconds
+	case timerUnitSeconds:
+		*u = timerUnitSeconds
+	case timerUnitDefault:
+		*u = timerUnitDefault
+	default:
+		return fmt.Errorf("invalid timer unit '%s'", v)
+	}
+	return nil
+}
+
+// seconds returns the factor to convert a value in this unit to seconds.
+// StatsD timers are in milliseconds unless configured otherwise.
+func (u timerUnit) seconds() float64 {
+	switch u {
+	case timerUnitNanoseconds:
+		return 1e-9
+	case timerUnitMicroseconds:
+		return 1e-6
+	case timerUnitMilliseconds, timerUnitDefault:
+		return 1e-3
+	case timerUnitSeconds:
+		return 1
+	default:
+		panic(fmt.Sprintf("unknown timer unit '%s'", u))
+	}
+}
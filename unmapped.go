@@ -0,0 +1,113 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var unmappedPrefixRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// unmappedPolicy configures what happens to metrics that match no mapping.
+type unmappedPolicy struct {
+	Action actionType `yaml:"action"`
+	// Prefix is prepended to the names of unmapped metrics.
+	Prefix string `yaml:"prefix"`
+	// Labels are added to all unmapped metrics.
+	Labels prometheus.Labels `yaml:"labels"`
+	// AllowPrefixes restricts the unmapped metrics that are exported to
+	// those whose StatsD name starts with one of the prefixes.
+	AllowPrefixes []string `yaml:"allow_prefixes"`
+	// SeparatePath exposes unmapped metrics on their own path rather than
+	// along with the mapped ones.
+	SeparatePath bool `yaml:"separate_path"`
+}
+
+// init validates the policy and fills in the defaults.
+func (p *unmappedPolicy) init() error {
+	if p.Action == actionTypeDefault {
+		p.Action = actionTypeMap
+	}
+	if p.Prefix != "" && !unmappedPrefixRE.MatchString(p.Prefix) {
+		return fmt.Errorf("invalid unmapped metric prefix: %s", p.Prefix)
+	}
+	for k := range p.Labels {
+		if !labelNameRE.MatchString(k) {
+			return fmt.Errorf("invalid unmapped metric label key: %s", k)
+		}
+	}
+	return nil
+}
+
+// allows reports whether an unmapped metric is exported.
+func (p *unmappedPolicy) allows(statsdMetric string) bool {
+	if p.Action == actionTypeDrop {
+		return false
+	}
+	if len(p.AllowPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.AllowPrefixes {
+		if strings.HasPrefix(statsdMetric, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the Prometheus name of an unmapped metric.
+func (p *unmappedPolicy) name(statsdMetric string) string {
+	return p.Prefix + escapeMetricName(statsdMetric)
+}
+
+// labels returns the labels of an unmapped metric. The policy's labels take
+// precedence over tags.
+func (p *unmappedPolicy) labels(tags map[string]string) prometheus.Labels {
+	labels := mergeLabels(tags, nil, labelPrecedenceDefault)
+	for k, v := range p.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// gatherer returns a gatherer for the series created from StatsD events. If
+// the unmapped policy exposes unmapped metrics on a separate path, it gathers
+// either only the unmapped or only the mapped metrics. Otherwise, the mapped
+// gatherer gathers all of them and the unmapped one none.
+func (b *Exporter) gatherer(unmapped bool) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if !b.mapper.unmappedPolicy().SeparatePath {
+			if unmapped {
+				return nil, nil
+			}
+			return b.registry.Gather()
+		}
+
+		mfs, err := b.registry.Gather()
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		filtered := mfs[:0]
+		for _, mf := range mfs {
+			if (b.unmappedNames[mf.GetName()] > 0) == unmapped {
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, err
+	})
+}
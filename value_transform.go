@@ -0,0 +1,76 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+type boundsAction string
+
+const (
+	boundsActionReject  boundsAction = "reject"
+	boundsActionClamp   boundsAction = "clamp"
+	boundsActionDefault boundsAction = ""
+)
+
+func (a *boundsAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch boundsAction(v) {
+	case boundsActionReject, boundsActionDefault:
+		*a = boundsActionReject
+	case boundsActionClamp:
+		*a = boundsActionClamp
+	default:
+		return fmt.Errorf("invalid out of bounds action %q", v)
+	}
+	return nil
+}
+
+// transformValue applies the mapping's scale and offset to an incoming value
+// and checks the result against the configured bounds. Neither offsets nor
+// bounds apply to relative values, e.g. gauge increments, as they say nothing
+// about the resulting value. It returns false if the value is out of bounds
+// and has to be rejected.
+func (m *metricMapping) transformValue(value float64, relative bool) (float64, bool) {
+	if m.Scale != nil {
+		value *= *m.Scale
+	}
+	if relative {
+		return value, true
+	}
+	if m.Offset != nil {
+		value += *m.Offset
+	}
+
+	if m.Min != nil && value < *m.Min {
+		if m.OutOfBounds != boundsActionClamp {
+			valuesOutOfBounds.WithLabelValues(m.identity(), string(boundsActionReject)).Inc()
+			return value, false
+		}
+		valuesOutOfBounds.WithLabelValues(m.identity(), string(boundsActionClamp)).Inc()
+		value = *m.Min
+	}
+	if m.Max != nil && value > *m.Max {
+		if m.OutOfBounds != boundsActionClamp {
+			valuesOutOfBounds.WithLabelValues(m.identity(), string(boundsActionReject)).Inc()
+			return value, false
+		}
+		valuesOutOfBounds.WithLabelValues(m.identity(), string(boundsActionClamp)).Inc()
+		value = *m.Max
+	}
+	return value, true
+}